@@ -1,130 +1,766 @@
-package main
+// Package client downloads and uploads files served by the file service.
+//
+// A Downloader fetches a file in chunks, optionally split across several
+// streams and connections, writes them into the destination through several
+// file descriptors, verifies every chunk and finally the
+// whole file, and resumes interrupted transfers according to its RetryPolicy.
+// Chunks that fail verification or cannot be written are re-fetched on their
+// own.
+package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/4erneff/alcatraz/client/util"
+	"github.com/4erneff/alcatraz/codec"
+	"github.com/4erneff/alcatraz/manifest"
 	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/synthetic"
+	"google.golang.org/grpc"
 )
 
-const (
-	serverAddr     = "localhost:50051"
-	outputFile     = "downloaded_file_parallel.mov"
-	fileChunkSize  = 1024 * 1024 // 1MB
-	numDescriptors = 4           // Number of parallel file descriptors
-)
+// Downloader downloads files from a server
+type Downloader struct {
+	client  pb.FileServiceClient   // Client metadata is fetched with, the first of clients
+	clients []pb.FileServiceClient // Clients the streams of a download are spread across
+	conns   []*grpc.ClientConn     // Connections dialed by New, nil if the client was provided
 
-// downloadFile starts or resumes the download from the last known chunk
-func downloadFile(client pb.FileServiceClient, startChunk int, totalChunks int32, totalSize int64) (int, error) {
-	req := &pb.FileRequest{
-		StartChunk: int32(startChunk),
+	addr             string
+	certFile         string
+	destDir          string
+	concurrency      int // File descriptors and workers chunks are written through
+	writeQueue       int // Received chunks that may wait for a worker
+	streams          int // Streams the chunks of a download are fetched on in parallel
+	connections      int // Connections New dials for the streams
+	chunkSize        int32
+	retry            RetryPolicy
+	maxChunkAttempts int
+	journal          bool       // Whether progress is persisted in a resume journal
+	sync             SyncPolicy // When written chunks are flushed to disk
+	window           int        // Chunks in flight on a flow-controlled transfer, 0 to use GetFileStream
+	sparse           bool       // Whether all-zero chunks are received as markers and written as holes
+	codecs           []string   // Compression codecs offered to the server, most preferred first
+	progress         ProgressFunc
+	trustedRoot      []byte
+	manifestKey      ed25519.PublicKey
+}
+
+// New returns a Downloader configured by opts. Unless WithClient is given it
+// dials the server; Close releases that connection.
+func New(opts ...Option) (*Downloader, error) {
+	d := &Downloader{
+		addr:             defaultServerAddr,
+		certFile:         defaultCertFile,
+		concurrency:      defaultConcurrency,
+		writeQueue:       defaultWriteQueue,
+		streams:          1,
+		connections:      1,
+		chunkSize:        defaultChunkSize,
+		retry:            DefaultRetryPolicy,
+		maxChunkAttempts: defaultMaxChunkAttempts,
+		journal:          true,
+		sync:             DefaultSyncPolicy,
+		sparse:           true,
+		codecs:           append([]string(nil), codec.Supported...),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be at least 1, got %d", d.concurrency)
+	}
+	if d.writeQueue < 0 {
+		return nil, fmt.Errorf("write queue must not be negative, got %d", d.writeQueue)
 	}
+	if d.streams < 1 {
+		return nil, fmt.Errorf("streams must be at least 1, got %d", d.streams)
+	}
+	if d.connections < 1 {
+		return nil, fmt.Errorf("connections must be at least 1, got %d", d.connections)
+	}
+	if d.window < 0 {
+		return nil, fmt.Errorf("transfer window must not be negative, got %d", d.window)
+	}
+	if d.sync.Mode < SyncInterval || d.sync.Mode > SyncNone {
+		return nil, fmt.Errorf("unknown sync mode %d", d.sync.Mode)
+	}
+	if d.sync.Mode == SyncInterval && d.sync.Interval < 1 {
+		return nil, fmt.Errorf("sync interval must be at least 1, got %d", d.sync.Interval)
+	}
+	for _, name := range d.codecs {
+		if !codec.Known(name) {
+			return nil, fmt.Errorf("unknown codec %q", name)
+		}
+	}
+	if d.maxChunkAttempts < 1 {
+		return nil, fmt.Errorf("max chunk attempts must be at least 1, got %d", d.maxChunkAttempts)
+	}
+
+	if d.client != nil {
+		d.clients = []pb.FileServiceClient{d.client}
+		return d, nil
+	}
+	for i := 0; i < d.connections; i++ {
+		conn, err := util.Dial(d.addr, d.certFile)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.conns = append(d.conns, conn)
+		d.clients = append(d.clients, pb.NewFileServiceClient(conn))
+	}
+	d.client = d.clients[0]
+	return d, nil
+}
+
+// Client returns the gRPC client the Downloader talks to
+func (d *Downloader) Client() pb.FileServiceClient {
+	return d.client
+}
 
-	stream, err := client.GetFileStream(context.Background(), req)
+// Close closes the connections dialed by New
+func (d *Downloader) Close() error {
+	var firstErr error
+	for _, conn := range d.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// permanentError marks a failure that retrying the download or upload cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// transfer is the state of a single Download
+type transfer struct {
+	fileID   string
+	metadata *pb.FileMetadataResponse // Server's description of the file; every chunk must use its chunk size
+	trusted  *pb.Manifest             // Manifest every chunk must match, nil without a trust anchor
+	expected *synthetic.Generator     // Content every chunk of a synthetic file must match, nil for other files
+	files    []*os.File
+	mutexes  []sync.Mutex
+	retries  *retrySet  // Chunks to fetch again
+	journal  *journal   // Chunks verified and written so far
+	writes   *writePool // Workers the received chunks are written by
+
+	progressMu sync.Mutex // Serializes calls to the progress callback
+}
+
+// ErrInsufficientSpace is returned when the destination filesystem cannot
+// hold the file being downloaded
+var ErrInsufficientSpace = errors.New("not enough free disk space for the download")
+
+// partialPath returns the path a download into dst is written to until it
+// has been verified
+func partialPath(dst string) string {
+	return dst + ".partial"
+}
+
+// Download fetches fileID into dst, resuming after failures according to
+// the retry policy. The file is written to <dst>.partial and only renamed to
+// dst once it has been verified against the whole-file checksum, so dst
+// never holds a partial or corrupt file. Progress is recorded in a journal
+// next to dst, so a later call resumes an interrupted download; it fails
+// with ErrSourceChanged if the file on the server has changed in the
+// meantime.
+func (d *Downloader) Download(ctx context.Context, fileID string, dst string) error {
+	if !filepath.IsAbs(dst) && d.destDir != "" {
+		dst = filepath.Join(d.destDir, dst)
+	}
+	partial := partialPath(dst)
+
+	var resumed *journal
+	if d.journal {
+		var err error
+		if resumed, err = loadJournal(dst); err != nil {
+			return err
+		}
+		if _, err := os.Stat(partial); resumed != nil && errors.Is(err, fs.ErrNotExist) {
+			resumed = nil // The chunks it vouches for are gone, start over
+		}
+	}
+	chunkSize := d.chunkSize
+	if resumed != nil {
+		chunkSize = resumed.state.ChunkSize // Offsets in the partial file were computed from it
+	}
+
+	// A synthetic file is verified chunk by chunk against its generator, so
+	// the server is spared hashing all of it before sending the first byte
+	_, syntheticErr := synthetic.Parse(fileID)
+	metadata, err := d.client.GetFileMetadata(ctx, &pb.FileMetadataRequest{FileId: fileID, ChunkSize: chunkSize, Checksum: syntheticErr != nil})
 	if err != nil {
-		fmt.Println("Failed to start file stream: %w", err)
-		return 0, err
+		return fmt.Errorf("fetching metadata of %s: %w", fileID, err)
+	}
+	if resumed != nil {
+		if err := resumed.matches(fileID, metadata); err != nil {
+			return fmt.Errorf("resuming download into %s: %w", dst, err)
+		}
+	}
+
+	trusted, err := d.fetchTrustedManifest(ctx, fileID, metadata)
+	if err != nil {
+		return fmt.Errorf("verifying manifest of %s: %w", fileID, err)
 	}
 
-	files, mutexes, err := util.CreateFileDescriptors(outputFile, numDescriptors)
+	expected, err := expectedContent(fileID, metadata.TotalSize)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	var holes []bool
+	if d.sparse {
+		holes = sparseHoles(metadata, trusted, resumed)
+		err = checkFreeBytes(partial, sparseSpace(metadata, holes))
+	} else {
+		err = checkFreeSpace(partial, metadata.TotalSize)
+	}
+	if err != nil {
+		return err
+	}
+	files, mutexes, err := util.CreateFileDescriptors(partial, d.concurrency)
+	if err != nil {
+		return err
 	}
 	defer func() {
 		for _, file := range files {
 			file.Close()
 		}
 	}()
+	// Reserve the space up front; this also cuts a stale partial file that is
+	// longer. A sparse download leaves out the chunks known to stay holes, so
+	// holes punched by an earlier run are not filled again.
+	if d.sparse {
+		err = reserveSparse(files[0], metadata, holes)
+	} else {
+		err = util.Preallocate(files[0], metadata.TotalSize)
+	}
+	if err != nil {
+		return fmt.Errorf("preallocating %s: %w", partial, err)
+	}
+
+	t := &transfer{
+		fileID:   fileID,
+		metadata: metadata,
+		trusted:  trusted,
+		expected: expected,
+		files:    files,
+		mutexes:  mutexes,
+		retries:  newRetrySet(),
+		journal:  resumed,
+	}
+	if t.journal == nil {
+		t.journal = newJournal(dst, fileID, metadata)
+		if !d.journal {
+			t.journal.path = "" // Track progress in memory only
+		}
+	}
+	t.journal.policy = d.sync
+	t.journal.sync = files[0].Sync
+	t.writes = d.startWritePool(t)
+	defer t.writes.close()
+
+	started := time.Now()
+	for attempt := 1; ; {
+		if err := t.retries.exhausted(d.maxChunkAttempts); err != nil {
+			t.journal.save() // Keep the chunks written so far for the next run
+			return fmt.Errorf("downloading %s: %w", fileID, err)
+		}
+		gaps := t.journal.gaps()
+		if len(gaps) == 0 {
+			break
+		}
+
+		done := t.journal.verifiedChunks()
+		err := d.fetchGaps(ctx, t, gaps)
+		if err == nil {
+			continue // Chunks that failed verification are gaps again
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if t.journal.verifiedChunks() > done {
+			// The round made progress, so the policy starts over instead of
+			// counting a long download's occasional failures against it
+			attempt, started = 1, time.Now()
+		}
+		if err := d.retry.wait(ctx, attempt, started, err); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("downloading %s: %w", fileID, err)
+		}
+		attempt++
+	}
+
+	if err := finalizeFile(files, partial, metadata.TotalSize); err != nil {
+		return err
+	}
+	files = nil // Closed by finalizeFile
+	if err := util.VerifyFile(partial, metadata.TotalSize, metadata.FileChecksum); err != nil {
+		t.journal.remove() // The journal vouched for corrupt data, start over next time
+		return fmt.Errorf("downloaded file is corrupt: %w", err)
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		return fmt.Errorf("moving the download into place: %w", err)
+	}
+	return t.journal.remove()
+}
+
+// checkFreeSpace fails with ErrInsufficientSpace if the filesystem of
+// partial cannot hold the rest of a file of size bytes. Space a partial file
+// from an earlier run already takes up counts as available.
+func checkFreeSpace(partial string, size int64) error {
+	need := size
+	if info, err := os.Stat(partial); err == nil {
+		need -= info.Size()
+	}
+	return checkFreeBytes(partial, need)
+}
+
+// checkFreeBytes returns ErrInsufficientSpace if the filesystem holding
+// partial has less than need bytes available
+func checkFreeBytes(partial string, need int64) error {
+	if need <= 0 {
+		return nil
+	}
+
+	free, err := util.FreeSpace(filepath.Dir(partial))
+	if errors.Is(err, util.ErrFreeSpaceUnknown) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking free space for %s: %w", partial, err)
+	}
+	if uint64(need) > free {
+		return fmt.Errorf("%w: %s needs %d more bytes, %d are available", ErrInsufficientSpace, partial, need, free)
+	}
+	return nil
+}
+
+// sparseHoles reports for every chunk of a sparse download whether it needs
+// no space: it was verified by an earlier run, which wrote it or punched it
+// as a hole, or the trusted manifest shows it is all zeros and so becomes a
+// hole. Without a manifest only the verified chunks are known.
+func sparseHoles(metadata *pb.FileMetadataResponse, trusted *pb.Manifest, resumed *journal) []bool {
+	holes := make([]bool, metadata.TotalChunks)
+	zeroLeaves := make(map[int64][]byte) // Leaf hash of a zero chunk by its length
+	for seq := range holes {
+		if resumed != nil && resumed.verifiedChunk(int32(seq)) {
+			holes[seq] = true
+			continue
+		}
+		if trusted != nil && seq < len(trusted.LeafHashes) {
+			length := chunkLength(metadata, int32(seq))
+			if zeroLeaves[length] == nil {
+				zeroLeaves[length] = manifest.LeafHash(make([]byte, length))
+			}
+			holes[seq] = bytes.Equal(trusted.LeafHashes[seq], zeroLeaves[length])
+		}
+	}
+	return holes
+}
+
+// sparseSpace returns the bytes a sparse download still has to write, those
+// of every chunk that is not one of holes
+func sparseSpace(metadata *pb.FileMetadataResponse, holes []bool) int64 {
+	need := metadata.TotalSize
+	for seq, hole := range holes {
+		if hole {
+			need -= chunkLength(metadata, int32(seq))
+		}
+	}
+	return need
+}
 
+// reserveSparse sets the length of a sparse download's file, cutting a stale
+// partial file that is longer, and reserves the space of every chunk that is
+// not one of holes. Those stay unallocated.
+func reserveSparse(file *os.File, metadata *pb.FileMetadataResponse, holes []bool) error {
+	if err := file.Truncate(metadata.TotalSize); err != nil {
+		return err
+	}
+	var missing []int32
+	for seq, hole := range holes {
+		if !hole {
+			missing = append(missing, int32(seq))
+		}
+	}
+	for _, run := range chunkRuns(missing) {
+		start := int64(run[0]) * int64(metadata.ChunkSize)
+		end := min(int64(run[1])*int64(metadata.ChunkSize), metadata.TotalSize)
+		if err := util.Reserve(file, start, end-start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalizeFile truncates the written file to its exact length, flushes it
+// to disk and closes its descriptors
+func finalizeFile(files []*os.File, path string, size int64) error {
+	err := files[0].Truncate(size)
+	if err == nil {
+		err = files[0].Sync()
+	}
+	for _, file := range files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("finalizing %s: %w", path, err)
+	}
+	return nil
+}
+
+// fetchGaps downloads the runs of chunks [start, end) the journal does not
+// hold yet, split across the streams of the Downloader, and checkpoints the
+// journal afterwards. A stream that fails does not stop the others; its
+// chunks remain gaps for the next attempt.
+func (d *Downloader) fetchGaps(ctx context.Context, t *transfer, gaps [][2]int32) error {
+	parts := splitGaps(gaps, d.streams)
+	errs := make([]error, len(parts))
 	var wg sync.WaitGroup
-	var resultErr error
-	lastPercent := 0
-	downloadedChunks := startChunk // Tracks the last chunk downloaded
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part [][2]int32) {
+			defer wg.Done()
+			client := d.clients[i%len(d.clients)]
+			if d.window > 0 {
+				errs[i] = d.transferFile(ctx, client, t, i, part)
+			} else {
+				errs[i] = d.downloadFile(ctx, client, t, part)
+			}
+		}(i, part)
+	}
+	wg.Wait()
+
+	if saveErr := t.journal.save(); saveErr != nil {
+		return &permanentError{fmt.Errorf("saving resume journal: %w", saveErr)}
+	}
+	var firstErr error
+	for _, err := range errs {
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
 
-	firstChunk := true
+// splitGaps divides the chunk runs gaps into at most n parts holding about
+// the same number of chunks, splitting runs where needed
+func splitGaps(gaps [][2]int32, n int) [][][2]int32 {
+	var total int32
+	for _, gap := range gaps {
+		total += gap[1] - gap[0]
+	}
+	perPart := (total + int32(n) - 1) / int32(n)
+
+	var parts [][][2]int32
+	var part [][2]int32
+	var size int32
+	for _, gap := range gaps {
+		for start := gap[0]; start < gap[1]; {
+			end := gap[1]
+			if end-start > perPart-size {
+				end = start + perPart - size
+			}
+			part = append(part, [2]int32{start, end})
+			size += end - start
+			start = end
+			if size == perPart {
+				parts = append(parts, part)
+				part, size = nil, 0
+			}
+		}
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// gapRequest returns the request for the chunk runs gaps. A single run is
+// asked for with StartChunk/EndChunk, several with Ranges.
+func gapRequest(t *transfer, gaps [][2]int32) *pb.FileRequest {
+	req := &pb.FileRequest{
+		FileId:    t.fileID,
+		ChunkSize: t.metadata.ChunkSize,
+	}
+	if len(gaps) == 1 {
+		req.StartChunk = gaps[0][0]
+		if gaps[0][1] < t.metadata.TotalChunks {
+			req.EndChunk = gaps[0][1]
+		}
+		return req
+	}
+	for _, gap := range gaps {
+		req.Ranges = append(req.Ranges, &pb.ChunkRange{StartChunk: gap[0], EndChunk: gap[1]})
+	}
+	return req
+}
+
+// downloadFile fetches the chunk runs gaps on one stream of client and hands
+// the chunks to the write pool, receiving no further while its queue is
+// full. It returns once every received chunk has been written or has failed;
+// a chunk only counts as downloaded once the journal holds it, so chunks that
+// failed verification, could not be written or were never sent remain gaps.
+func (d *Downloader) downloadFile(ctx context.Context, client pb.FileServiceClient, t *transfer, gaps [][2]int32) error {
+	req := gapRequest(t, gaps)
+	req.Sparse = d.sparse
+	req.Codecs = d.codecs
+	stream, err := client.GetFileStream(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[int32]bool)
+	for _, gap := range gaps {
+		for seq := gap[0]; seq < gap[1]; seq++ {
+			wanted[seq] = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	var resultErr error
 
 	for {
 		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			resultErr = err
 			break
 		}
-		downloadedChunks++
-
-		if firstChunk {
-			firstChunk = false
-			fmt.Printf("Starting file download/resume, total size: %.2f MB, total chunks: %d\n", float64(totalSize)/(1024*1024), totalChunks)
+		if chunk.ChunkSize != t.metadata.ChunkSize {
+			resultErr = &permanentError{fmt.Errorf("chunk %d uses %d byte chunks, metadata reported %d", chunk.SequenceNumber, chunk.ChunkSize, t.metadata.ChunkSize)}
+			break
 		}
-
-		// Display progress in percentage
-		progress := float64(downloadedChunks) / float64(totalChunks) * 100
-		if p := int(progress); p > lastPercent && p%10 == 0 {
-			fmt.Printf("\rDownloading... %d%% complete", p)
-			lastPercent = p
+		if !wanted[chunk.SequenceNumber] {
+			continue // Not asked for, or already received
+		}
+		delete(wanted, chunk.SequenceNumber)
+		if t.journal.verifiedChunk(chunk.SequenceNumber) {
+			continue // Written by an earlier run
 		}
 
 		wg.Add(1)
-		go handleChunk(chunk, &wg, files, mutexes)
+		err = t.writes.submit(ctx, writeJob{chunk: chunk, done: func(err error) {
+			defer wg.Done()
+			if err != nil {
+				t.retries.fail(chunk.SequenceNumber, err) // Fetched again as a gap
+				return
+			}
+			d.reportProgress(t)
+		}})
+		if err != nil {
+			wg.Done()
+			resultErr = err
+			break
+		}
 	}
 
 	wg.Wait()
-	return downloadedChunks, resultErr
+	if resultErr == nil {
+		// The stream ended cleanly without some chunks, count that against them
+		for seq := range wanted {
+			t.retries.fail(seq, fmt.Errorf("chunk %d was not sent", seq))
+		}
+	}
+	return resultErr
 }
 
-func handleChunk(chunk *pb.FileChunk, wg *sync.WaitGroup, files []*os.File, mutexes []sync.Mutex) {
-	defer wg.Done()
-
-	if !util.VerifyChecksum(chunk.ChunkData, chunk.Checksum) {
-		log.Fatalf("Checksum mismatch on chunk %d, ignoring chunk\n", chunk.SequenceNumber)
+// reportProgress passes the number of verified chunks to the progress callback
+func (d *Downloader) reportProgress(t *transfer) {
+	if d.progress == nil {
 		return
 	}
+	t.progressMu.Lock()
+	defer t.progressMu.Unlock()
+	d.progress(Progress{
+		FileID:           t.fileID,
+		DownloadedChunks: t.journal.verifiedChunks(),
+		TotalChunks:      t.metadata.TotalChunks,
+		TotalSize:        t.metadata.TotalSize,
+		QueuedChunks:     t.writes.depth(),
+	})
+}
+
+// handleChunk verifies a chunk, writes it at its offset in the output file
+// and records it in the journal
+func (d *Downloader) handleChunk(t *transfer, chunk *pb.FileChunk) error {
+	// Where the chunk is written and which journal bit it sets follow from
+	// these, so they are checked even when no manifest is trusted
+	if chunk.SequenceNumber < 0 || chunk.SequenceNumber >= t.metadata.TotalChunks {
+		return fmt.Errorf("chunk %d outside of [0, %d)", chunk.SequenceNumber, t.metadata.TotalChunks)
+	}
+	if chunk.ChunkSize != t.metadata.ChunkSize {
+		return fmt.Errorf("chunk %d uses %d byte chunks, metadata reported %d", chunk.SequenceNumber, chunk.ChunkSize, t.metadata.ChunkSize)
+	}
+	length := chunkLength(t.metadata, chunk.SequenceNumber)
+
+	data := chunk.ChunkData
+	if chunk.Codec != codec.None {
+		decompressed, err := codec.Decompress(chunk.Codec, data, int(length))
+		if err != nil {
+			return fmt.Errorf("decompressing chunk %d: %w", chunk.SequenceNumber, err)
+		}
+		data = decompressed
+	}
+	zero := len(data) == 0 && chunk.ZeroLength > 0 // Marker standing in for all-zero data
+	if zero {
+		if chunk.ZeroLength != length {
+			return fmt.Errorf("zero marker of chunk %d covers %d bytes, expected %d", chunk.SequenceNumber, chunk.ZeroLength, length)
+		}
+		if t.trusted != nil || t.expected != nil {
+			data = make([]byte, chunk.ZeroLength) // Verified like the bytes it stands for
+		}
+	} else if int64(len(data)) != length {
+		return fmt.Errorf("chunk %d has %d bytes, expected %d", chunk.SequenceNumber, len(data), length)
+	} else if !util.VerifyChecksum(data, chunk.Checksum) {
+		return fmt.Errorf("checksum mismatch on chunk %d", chunk.SequenceNumber)
+	}
+	if t.trusted != nil {
+		if err := manifest.VerifyChunk(t.trusted, chunk.SequenceNumber, data); err != nil {
+			return fmt.Errorf("untrusted chunk %d: %w", chunk.SequenceNumber, err)
+		}
+	}
+	if t.expected != nil {
+		if err := verifySynthetic(t.expected, data, int64(chunk.SequenceNumber)*int64(t.metadata.ChunkSize)); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.SequenceNumber, err)
+		}
+	}
 
-	// Calculate the offset in the file based on the sequence number
-	offset := int64(chunk.SequenceNumber) * int64(fileChunkSize)
+	// Calculate the offset in the file based on the sequence number and the negotiated chunk size
+	offset := int64(chunk.SequenceNumber) * int64(t.metadata.ChunkSize)
 
-	fdIndex := int(chunk.SequenceNumber) % numDescriptors
-	file := files[fdIndex]
+	fdIndex := int(chunk.SequenceNumber) % len(t.files)
+	file := t.files[fdIndex]
 
-	mutexes[fdIndex].Lock()
+	var err error
+	t.mutexes[fdIndex].Lock()
+	if zero {
+		err = util.ZeroRange(file, offset, chunk.ZeroLength)
+	} else {
+		_, err = file.WriteAt(data, offset)
+	}
+	t.mutexes[fdIndex].Unlock()
+	if err != nil {
+		return fmt.Errorf("writing chunk at offset %d: %w", offset, err)
+	}
 
-	if _, err := file.WriteAt(chunk.ChunkData, offset); err != nil {
-		log.Fatalf("Failed to write chunk at offset %d: %v", offset, err)
+	if err := t.journal.markVerified(chunk.SequenceNumber); err != nil {
+		return fmt.Errorf("saving resume journal: %w", err)
 	}
-	mutexes[fdIndex].Unlock()
+	return nil
 }
 
-func main() {
-	conn, err := util.GetConn()
-	if err != nil {
-		log.Fatalf("Failed to start a connection: %v", err)
+// chunkLength returns the number of bytes of chunk seq of the file described by metadata
+func chunkLength(metadata *pb.FileMetadataResponse, seq int32) int64 {
+	offset := int64(seq) * int64(metadata.ChunkSize)
+	if remaining := metadata.TotalSize - offset; remaining < int64(metadata.ChunkSize) {
+		return remaining
 	}
-	defer conn.Close()
+	return int64(metadata.ChunkSize)
+}
 
-	client := pb.NewFileServiceClient(conn)
+// ErrSyntheticMismatch is returned when the content of a synthetic file
+// differs from the bytes the client regenerates locally
+var ErrSyntheticMismatch = errors.New("content differs from the synthetic file")
 
-	metadata, err := client.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{})
+// expectedContent returns the generator of fileID if it names a synthetic
+// file, or nil for any other file. The size the server reports must match.
+func expectedContent(fileID string, size int64) (*synthetic.Generator, error) {
+	expected, err := synthetic.Parse(fileID)
 	if err != nil {
-		log.Fatalf("Failed to fetch file metadata: %v", err)
+		return nil, nil
+	}
+	if expected.Size() != size {
+		return nil, fmt.Errorf("%w: server reports %d bytes, %s has %d", ErrSyntheticMismatch, size, fileID, expected.Size())
 	}
+	return expected, nil
+}
 
-	var startChunk = 0
-	for {
-		lastChunk, err := downloadFile(client, startChunk, metadata.TotalChunks, metadata.TotalSize)
-		if lastChunk == int(metadata.TotalChunks) {
-			fmt.Println("\nFile download complete")
-			return
-		}
+// verifySynthetic checks data received at offset against the regenerated content
+func verifySynthetic(expected *synthetic.Generator, data []byte, offset int64) error {
+	want := make([]byte, len(data))
+	if n, _ := expected.ReadAt(want, offset); n != len(data) || !bytes.Equal(want, data) {
+		return fmt.Errorf("%w at offset %d", ErrSyntheticMismatch, offset)
+	}
+	return nil
+}
 
+// fetchManifest fetches every page of the manifest of a file and joins their
+// leaf hashes. All pages must describe the same file, chunking and root.
+func fetchManifest(ctx context.Context, client pb.FileServiceClient, fileID string, chunkSize int32) (*pb.Manifest, error) {
+	m, err := client.GetManifest(ctx, &pb.ManifestRequest{FileId: fileID, ChunkSize: chunkSize})
+	if err != nil {
+		return nil, err
+	}
+	for len(m.LeafHashes) < int(m.TotalChunks) {
+		page, err := client.GetManifest(ctx, &pb.ManifestRequest{FileId: fileID, ChunkSize: m.ChunkSize, StartChunk: int32(len(m.LeafHashes))})
 		if err != nil {
-			fmt.Println("Error while downloading, retry in 10 seconds: ", err.Error())
-			time.Sleep(10 * time.Second)
+			return nil, err
 		}
-		startChunk = lastChunk
+		switch {
+		case page.StartChunk != int32(len(m.LeafHashes)):
+			return nil, fmt.Errorf("manifest page starts at chunk %d, expected %d", page.StartChunk, len(m.LeafHashes))
+		case len(page.LeafHashes) == 0:
+			return nil, fmt.Errorf("manifest ends after %d of %d leaf hashes", len(m.LeafHashes), m.TotalChunks)
+		case page.TotalSize != m.TotalSize || page.TotalChunks != m.TotalChunks || page.ChunkSize != m.ChunkSize ||
+			!bytes.Equal(page.RootHash, m.RootHash) || !bytes.Equal(page.Signature, m.Signature):
+			return nil, errors.New("manifest changed between pages")
+		}
+		m.LeafHashes = append(m.LeafHashes, page.LeafHashes...)
+	}
+	return m, nil
+}
+
+// fetchTrustedManifest fetches the manifest of the file for the chunk size
+// in metadata and verifies its root against the trusted root and/or manifest
+// key. It returns nil if neither is configured.
+func (d *Downloader) fetchTrustedManifest(ctx context.Context, fileID string, metadata *pb.FileMetadataResponse) (*pb.Manifest, error) {
+	if d.trustedRoot == nil && d.manifestKey == nil {
+		return nil, nil
 	}
 
+	trusted, err := fetchManifest(ctx, d.client, fileID, metadata.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if trusted.ChunkSize != metadata.ChunkSize {
+		return nil, fmt.Errorf("manifest uses %d byte chunks, expected %d", trusted.ChunkSize, metadata.ChunkSize)
+	}
+	if trusted.TotalSize != metadata.TotalSize {
+		return nil, fmt.Errorf("manifest describes %d bytes, metadata %d", trusted.TotalSize, metadata.TotalSize)
+	}
+	if err := manifest.Verify(trusted, d.trustedRoot, d.manifestKey); err != nil {
+		return nil, err
+	}
+	return trusted, nil
 }
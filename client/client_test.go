@@ -1,17 +1,22 @@
-package main
+package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
-	"testing"
-
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"testing"
 
+	"github.com/4erneff/alcatraz/client/util"
+	"github.com/4erneff/alcatraz/codec"
+	"github.com/4erneff/alcatraz/manifest"
 	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/synthetic"
 	"github.com/stretchr/testify/mock"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
@@ -26,11 +31,41 @@ func (m *MockFileServiceClient) GetFileStream(ctx context.Context, in *pb.FileRe
 	return args.Get(0).(pb.FileService_GetFileStreamClient), args.Error(1)
 }
 
+func (m *MockFileServiceClient) ListFiles(ctx context.Context, in *pb.ListFilesRequest, opts ...grpc.CallOption) (*pb.ListFilesResponse, error) {
+	args := m.Called(ctx, in)
+	return args.Get(0).(*pb.ListFilesResponse), args.Error(1)
+}
+
 func (m *MockFileServiceClient) GetFileMetadata(ctx context.Context, in *pb.FileMetadataRequest, opts ...grpc.CallOption) (*pb.FileMetadataResponse, error) {
 	args := m.Called(ctx, in)
 	return args.Get(0).(*pb.FileMetadataResponse), args.Error(1)
 }
 
+func (m *MockFileServiceClient) GetManifest(ctx context.Context, in *pb.ManifestRequest, opts ...grpc.CallOption) (*pb.Manifest, error) {
+	args := m.Called(ctx, in)
+	return args.Get(0).(*pb.Manifest), args.Error(1)
+}
+
+func (m *MockFileServiceClient) StartUpload(ctx context.Context, in *pb.StartUploadRequest, opts ...grpc.CallOption) (*pb.UploadStatus, error) {
+	args := m.Called(ctx, in)
+	return args.Get(0).(*pb.UploadStatus), args.Error(1)
+}
+
+func (m *MockFileServiceClient) UploadFile(ctx context.Context, opts ...grpc.CallOption) (pb.FileService_UploadFileClient, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(pb.FileService_UploadFileClient), args.Error(1)
+}
+
+func (m *MockFileServiceClient) GetUploadStatus(ctx context.Context, in *pb.UploadStatusRequest, opts ...grpc.CallOption) (*pb.UploadStatus, error) {
+	args := m.Called(ctx, in)
+	return args.Get(0).(*pb.UploadStatus), args.Error(1)
+}
+
+func (m *MockFileServiceClient) Transfer(ctx context.Context, opts ...grpc.CallOption) (pb.FileService_TransferClient, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(pb.FileService_TransferClient), args.Error(1)
+}
+
 type MockFileService_GetFileStreamClient struct {
 	mock.Mock
 }
@@ -70,68 +105,91 @@ func (m *MockFileService_GetFileStreamClient) RecvMsg(msg interface{}) error {
 	return args.Error(0)
 }
 
-func TestDownloadFile_Success(t *testing.T) {
-	// Create a temporary file for download output.
-	tmpFile, err := ioutil.TempFile("", "downloaded_file_parallel.mov")
+// testFileID is the file the mocked server serves
+const testFileID = "large_file.bin"
+
+// testMetadata describes a file of the given number of zeroed full chunks
+func testMetadata(totalChunks int32) *pb.FileMetadataResponse {
+	totalSize := int64(totalChunks) * defaultChunkSize
+	return &pb.FileMetadataResponse{
+		TotalSize:    totalSize,
+		TotalChunks:  totalChunks,
+		ChunkSize:    defaultChunkSize,
+		FileChecksum: fmt.Sprintf("%x", sha256.Sum256(make([]byte, totalSize))),
+	}
+}
+
+// zeroChunk returns chunk i of the file described by testMetadata
+func zeroChunk(i int) *pb.FileChunk {
+	data := make([]byte, defaultChunkSize)
+	return &pb.FileChunk{
+		SequenceNumber: int32(i),
+		ChunkData:      data,
+		ChunkSize:      defaultChunkSize,
+		Checksum:       fmt.Sprintf("%x", sha256.Sum256(data)), // Assume checksum verification passes
+	}
+}
+
+// newTestDownloader returns a Downloader talking to a mocked client
+func newTestDownloader(t *testing.T, mockClient *MockFileServiceClient, opts ...Option) *Downloader {
+	opts = append([]Option{WithClient(mockClient), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}), WithCodecs()}, opts...)
+	d, err := New(opts...)
 	if err != nil {
-		t.Fatalf("Failed to create temp file: %v", err)
+		t.Fatalf("Failed to create downloader: %v", err)
 	}
-	defer os.Remove(tmpFile.Name()) // Cleanup the temporary file after the test
+	return d
+}
+
+func TestDownloadFile_Success(t *testing.T) {
+	// Download into a temporary directory.
+	dir := t.TempDir()
 
 	mockClient := new(MockFileServiceClient)
 	mockStream := new(MockFileService_GetFileStreamClient)
 	for i := 0; i < 10; i++ {
-		data := make([]byte, fileChunkSize)
-		chunk := &pb.FileChunk{
-			SequenceNumber: int32(i),
-			ChunkData:      data,
-			Checksum:       fmt.Sprintf("%x", sha256.Sum256(data)), // Assume checksum verification passes
-		}
-		mockStream.On("Recv").Return(chunk, nil).Once()
+		mockStream.On("Recv").Return(zeroChunk(i), nil).Once()
 	}
 	mockStream.On("Recv").Return(&pb.FileChunk{}, io.EOF)
 
-	// Mock the file stream
+	// Mock the metadata and the file stream
+	mockClient.On("GetFileMetadata", mock.Anything, &pb.FileMetadataRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Checksum: true}).Return(testMetadata(10), nil)
 	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return(mockStream, nil)
 
-	startChunk := 0
-	lc, err := downloadFile(mockClient, startChunk, 10, int64(10*fileChunkSize))
-	if err != nil && lc != 10 {
-		t.Fatalf("downloadFile failed: %v", err)
+	var reported []int32
+	d := newTestDownloader(t, mockClient, WithDestinationDir(dir), WithProgress(func(p Progress) {
+		reported = append(reported, p.DownloadedChunks)
+	}))
+	if err := d.Download(context.Background(), testFileID, "out.bin"); err != nil {
+		t.Fatalf("Download failed: %v", err)
 	}
 
+	if info, err := os.Stat(filepath.Join(dir, "out.bin")); err != nil || info.Size() != 10*defaultChunkSize {
+		t.Errorf("Expected a 10 chunk file in the destination directory, got %v, %v", info, err)
+	}
+	if len(reported) != 10 || reported[9] != 10 {
+		t.Errorf("Expected progress for every chunk, got %v", reported)
+	}
 	mockClient.AssertExpectations(t)
 	mockStream.AssertExpectations(t)
 }
 
 func TestDownloadFile_ConnectionDrop(t *testing.T) {
-	// Create a temporary file for download output.
-	tmpFile, err := ioutil.TempFile("", "downloaded_file_parallel.mov")
-	if err != nil {
-		t.Fatalf("Failed to create temp file: %v", err)
-	}
-	defer os.Remove(tmpFile.Name()) // Cleanup the temporary file after the test
+	dst := filepath.Join(t.TempDir(), "out.bin")
 
 	// Mock the gRPC client and stream
 	mockClient := new(MockFileServiceClient)
 	mockStream := new(MockFileService_GetFileStreamClient)
 
 	for i := 0; i < 6; i++ {
-		data := make([]byte, fileChunkSize)
-		chunk := &pb.FileChunk{
-			SequenceNumber: int32(i),
-			ChunkData:      data,
-			Checksum:       fmt.Sprintf("%x", sha256.Sum256(data)), // Assume checksum verification passes
-		}
-		mockStream.On("Recv").Return(chunk, nil).Once()
+		mockStream.On("Recv").Return(zeroChunk(i), nil).Once()
 	}
 
-	// Simulate a connection drop (error) after receiving 5 chunks
+	// Simulate a connection drop (error) after receiving 6 chunks
 	mockStream.On("Recv").Return(&pb.FileChunk{}, errors.New("connection dropped")).Once()
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(10), nil)
 	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return(mockStream, nil)
 
-	startChunk := 0
-	_, err = downloadFile(mockClient, startChunk, 10, int64(10*fileChunkSize))
+	err := newTestDownloader(t, mockClient).Download(context.Background(), testFileID, dst)
 
 	if err == nil {
 		t.Fatalf("Expected connection drop error, but got nil")
@@ -140,3 +198,485 @@ func TestDownloadFile_ConnectionDrop(t *testing.T) {
 	mockClient.AssertExpectations(t)
 	mockStream.AssertExpectations(t)
 }
+
+func TestDownloadFile_Resume(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(4), nil)
+
+	// The first stream drops after two chunks, the second one resumes at chunk 2
+	first := new(MockFileService_GetFileStreamClient)
+	first.On("Recv").Return(zeroChunk(0), nil).Once()
+	first.On("Recv").Return(zeroChunk(1), nil).Once()
+	first.On("Recv").Return(&pb.FileChunk{}, errors.New("connection dropped")).Once()
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: 0, ChunkSize: defaultChunkSize, Sparse: true}).Return(first, nil).Once()
+
+	second := new(MockFileService_GetFileStreamClient)
+	second.On("Recv").Return(zeroChunk(2), nil).Once()
+	second.On("Recv").Return(zeroChunk(3), nil).Once()
+	second.On("Recv").Return(&pb.FileChunk{}, io.EOF)
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: 2, ChunkSize: defaultChunkSize, Sparse: true}).Return(second, nil).Once()
+
+	d := newTestDownloader(t, mockClient, WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	if err := d.Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Expected the download to resume, got %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestDownloadFile_ProgressResetsRetries(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(4), nil)
+
+	// Every stream delivers one chunk before it drops, more failures than the
+	// policy allows in a row
+	for i := 0; i < 3; i++ {
+		stream := new(MockFileService_GetFileStreamClient)
+		stream.On("Recv").Return(zeroChunk(i), nil).Once()
+		stream.On("Recv").Return(&pb.FileChunk{}, errors.New("connection dropped")).Once()
+		mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: int32(i), ChunkSize: defaultChunkSize, Sparse: true}).Return(stream, nil).Once()
+	}
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: 3, ChunkSize: defaultChunkSize, Sparse: true}).Return(chunkStream(zeroChunk(3)), nil).Once()
+
+	d := newTestDownloader(t, mockClient, WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	if err := d.Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Expected a download making progress to keep retrying, got %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+// corruptChunk returns chunk i with a checksum that does not match its data
+func corruptChunk(i int) *pb.FileChunk {
+	chunk := zeroChunk(i)
+	chunk.Checksum = fmt.Sprintf("%x", sha256.Sum256([]byte("other")))
+	return chunk
+}
+
+// chunkStream returns a stream sending the given chunks followed by io.EOF
+func chunkStream(chunks ...*pb.FileChunk) *MockFileService_GetFileStreamClient {
+	stream := new(MockFileService_GetFileStreamClient)
+	for _, chunk := range chunks {
+		stream.On("Recv").Return(chunk, nil).Once()
+	}
+	stream.On("Recv").Return(&pb.FileChunk{}, io.EOF)
+	return stream
+}
+
+func TestDownloadFile_CorruptChunkRefetched(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(4), nil)
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(zeroChunk(0), corruptChunk(1), corruptChunk(2), zeroChunk(3)), nil).Once()
+
+	// Only the corrupt run [1, 3) is fetched again, the first retry still corrupts chunk 2
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: 1, EndChunk: 3, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(zeroChunk(1), corruptChunk(2)), nil).Once()
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: 2, EndChunk: 3, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(zeroChunk(2)), nil).Once()
+
+	if err := newTestDownloader(t, mockClient).Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Expected the corrupt chunks to be fetched again, got %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestDownloadFile_CorruptChunkExhausted(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(1), nil)
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(corruptChunk(0)), nil).Once()
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(corruptChunk(0)), nil).Once()
+
+	err := newTestDownloader(t, mockClient, WithMaxChunkAttempts(2)).Download(context.Background(), testFileID, dst)
+	if err == nil || !strings.Contains(err.Error(), "chunk 0 failed 2 times") {
+		t.Fatalf("Expected the download to fail after 2 attempts at chunk 0, got %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestDownloadFile_Synthetic(t *testing.T) {
+	const fileID = "synthetic/2MiB?seed=42"
+	expected, err := synthetic.Parse(fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, expected.Size())
+	expected.ReadAt(content, 0)
+	chunk := func(i int, data []byte) *pb.FileChunk {
+		return &pb.FileChunk{SequenceNumber: int32(i), ChunkData: data, ChunkSize: defaultChunkSize, Checksum: fmt.Sprintf("%x", sha256.Sum256(data))}
+	}
+	metadata := &pb.FileMetadataResponse{TotalSize: expected.Size(), TotalChunks: 2, ChunkSize: defaultChunkSize}
+
+	// Synthetic content is checked against the generator, the server is not
+	// asked to hash the whole file
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, &pb.FileMetadataRequest{FileId: fileID, ChunkSize: defaultChunkSize}).Return(metadata, nil)
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).
+		Return(chunkStream(chunk(0, content[:defaultChunkSize]), chunk(1, content[defaultChunkSize:])), nil).Once()
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	if err := newTestDownloader(t, mockClient).Download(context.Background(), fileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	// Bytes that differ from the regenerated content are rejected, even with a matching checksum
+	tampered := append([]byte(nil), content[defaultChunkSize:]...)
+	tampered[0]++
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).
+		Return(chunkStream(chunk(0, content[:defaultChunkSize]), chunk(1, tampered)), nil).Once()
+	err = newTestDownloader(t, mockClient, WithMaxChunkAttempts(1)).Download(context.Background(), fileID, filepath.Join(t.TempDir(), "out.bin"))
+	if !errors.Is(err, ErrSyntheticMismatch) {
+		t.Fatalf("Expected ErrSyntheticMismatch, got %v", err)
+	}
+
+	if _, err := expectedContent(fileID, 1024); !errors.Is(err, ErrSyntheticMismatch) {
+		t.Fatalf("Expected a size mismatch to be rejected, got %v", err)
+	}
+	if gen, err := expectedContent(testFileID, 1024); gen != nil || err != nil {
+		t.Fatalf("Expected nothing to verify for a stored file, got %v, %v", gen, err)
+	}
+}
+
+func TestDownloadFile_Sparse(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	// A stale partial file must not leak into the chunks sent as markers
+	stale := make([]byte, 3*defaultChunkSize)
+	for i := range stale {
+		stale[i] = 0xff
+	}
+	if err := os.WriteFile(partialPath(dst), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	marker := func(i int, length int64) *pb.FileChunk {
+		return &pb.FileChunk{SequenceNumber: int32(i), ChunkSize: defaultChunkSize, Offset: int64(i) * defaultChunkSize, ZeroLength: length}
+	}
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(3), nil)
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(marker(0, defaultChunkSize), zeroChunk(1), marker(2, 10)), nil).Once()
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: 2, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(marker(2, defaultChunkSize)), nil).Once()
+
+	if err := newTestDownloader(t, mockClient).Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	mockClient.AssertExpectations(t)
+	data, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(data, make([]byte, 3*defaultChunkSize)) {
+		t.Fatalf("Expected %d zero bytes, got %d bytes, %v", 3*defaultChunkSize, len(data), err)
+	}
+}
+
+func TestHandleChunk_Rejects(t *testing.T) {
+	metadata := &pb.FileMetadataResponse{TotalSize: defaultChunkSize + 4, TotalChunks: 2, ChunkSize: defaultChunkSize}
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	files, mutexes, err := util.CreateFileDescriptors(dst, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files[0].Close()
+	tr := &transfer{fileID: testFileID, metadata: metadata, files: files, mutexes: mutexes, journal: newJournal(dst, testFileID, metadata)}
+	tr.journal.path = ""
+	d := newTestDownloader(t, new(MockFileServiceClient))
+
+	tail := []byte("tail")
+	chunk := func(seq, chunkSize int32, data []byte) *pb.FileChunk {
+		return &pb.FileChunk{SequenceNumber: seq, ChunkSize: chunkSize, ChunkData: data, Checksum: util.Checksum(data)}
+	}
+	for name, c := range map[string]*pb.FileChunk{
+		"past the last chunk":  chunk(2, defaultChunkSize, tail),
+		"negative":             chunk(-1, defaultChunkSize, tail),
+		"other chunk size":     chunk(1, defaultChunkSize/2, tail),
+		"longer than expected": chunk(1, defaultChunkSize, []byte("tail and more")),
+		"shorter than a chunk": chunk(0, defaultChunkSize, tail),
+	} {
+		if err := d.handleChunk(tr, c); err == nil {
+			t.Errorf("Expected a chunk %s to be rejected", name)
+		}
+	}
+	if info, err := files[0].Stat(); err != nil || info.Size() != 0 || tr.journal.verifiedChunks() != 0 {
+		t.Fatalf("Rejected chunks should not be written or journaled, got %v, %v", info, err)
+	}
+
+	if err := d.handleChunk(tr, chunk(1, defaultChunkSize, tail)); err != nil || !tr.journal.verifiedChunk(1) {
+		t.Fatalf("Expected the last chunk to be written, got %v", err)
+	}
+}
+
+func TestSparseSpace(t *testing.T) {
+	metadata := &pb.FileMetadataResponse{TotalSize: 3*defaultChunkSize + 10, TotalChunks: 4, ChunkSize: defaultChunkSize}
+	if need := sparseSpace(metadata, sparseHoles(metadata, nil, nil)); need != metadata.TotalSize {
+		t.Errorf("Without a manifest every chunk should count, got %d", need)
+	}
+
+	// Chunks 1 and 3 are zeros, chunk 0 has been written by an earlier run
+	data := make([]byte, defaultChunkSize)
+	data[0] = 1
+	trusted := &pb.Manifest{LeafHashes: [][]byte{
+		manifest.LeafHash(data),
+		manifest.LeafHash(make([]byte, defaultChunkSize)),
+		manifest.LeafHash(data),
+		manifest.LeafHash(make([]byte, 10)),
+	}}
+	resumed := newJournal(filepath.Join(t.TempDir(), "out.bin"), testFileID, metadata)
+	resumed.path = ""
+	resumed.policy = SyncPolicy{Mode: SyncOnComplete}
+	if err := resumed.markVerified(0); err != nil {
+		t.Fatal(err)
+	}
+	holes := sparseHoles(metadata, trusted, resumed)
+	if need := sparseSpace(metadata, holes); need != defaultChunkSize {
+		t.Errorf("Expected only chunk 2 to need space, got %d bytes", need)
+	}
+
+	// A stale partial file that is longer is cut to the file's length
+	file, err := os.Create(filepath.Join(t.TempDir(), "out.bin.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Truncate(2 * metadata.TotalSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := reserveSparse(file, metadata, holes); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != metadata.TotalSize {
+		t.Errorf("Expected the partial file to be cut to %d bytes, got %v, %v", metadata.TotalSize, info, err)
+	}
+}
+
+func TestDownloadFile_Compressed(t *testing.T) {
+	content := bytes.Repeat([]byte("GET /index.html 200\n"), 2*defaultChunkSize/20+1)[:2*defaultChunkSize]
+	compressed := func(i int, name string) *pb.FileChunk {
+		data := content[i*defaultChunkSize : (i+1)*defaultChunkSize]
+		packed, err := codec.Compress(name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pb.FileChunk{SequenceNumber: int32(i), ChunkData: packed, Codec: name, ChunkSize: defaultChunkSize, Checksum: fmt.Sprintf("%x", sha256.Sum256(data))}
+	}
+	metadata := &pb.FileMetadataResponse{TotalSize: int64(len(content)), TotalChunks: 2, ChunkSize: defaultChunkSize, FileChecksum: fmt.Sprintf("%x", sha256.Sum256(content))}
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(metadata, nil)
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Sparse: true, Codecs: []string{codec.Zstd, codec.Gzip}}).
+		Return(chunkStream(compressed(0, codec.Zstd), compressed(1, codec.Gzip)), nil).Once()
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	if err := newTestDownloader(t, mockClient, WithCodecs(codec.Zstd, codec.Gzip)).Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	mockClient.AssertExpectations(t)
+	if data, err := os.ReadFile(dst); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Expected the decompressed content, got %d bytes, %v", len(data), err)
+	}
+
+	// A chunk that decompresses to more than its length is rejected
+	bomb, err := codec.Compress(codec.Zstd, make([]byte, 2*defaultChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).
+		Return(chunkStream(&pb.FileChunk{SequenceNumber: 0, ChunkData: bomb, Codec: codec.Zstd, ChunkSize: defaultChunkSize}), nil).Once()
+	err = newTestDownloader(t, mockClient, WithMaxChunkAttempts(1)).Download(context.Background(), testFileID, filepath.Join(t.TempDir(), "out.bin"))
+	if !errors.Is(err, codec.ErrTooLarge) {
+		t.Fatalf("Expected ErrTooLarge, got %v", err)
+	}
+
+	if _, err := New(WithClient(mockClient), WithCodecs("lz4")); err == nil {
+		t.Fatalf("Expected unknown codecs to be rejected")
+	}
+}
+
+func TestFetchTrustedManifest(t *testing.T) {
+	chunks := [][]byte{make([]byte, defaultChunkSize), []byte("tail")}
+	trusted := &pb.Manifest{FileId: testFileID, TotalSize: defaultChunkSize + 4, TotalChunks: 2, ChunkSize: defaultChunkSize}
+	for _, chunk := range chunks {
+		trusted.LeafHashes = append(trusted.LeafHashes, manifest.LeafHash(chunk))
+	}
+	trusted.RootHash = manifest.RootHash(trusted.LeafHashes)
+	metadata := &pb.FileMetadataResponse{TotalSize: trusted.TotalSize, TotalChunks: 2, ChunkSize: defaultChunkSize}
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetManifest", mock.Anything, &pb.ManifestRequest{FileId: testFileID, ChunkSize: defaultChunkSize}).Return(trusted, nil)
+	ctx := context.Background()
+
+	m, err := newTestDownloader(t, mockClient).fetchTrustedManifest(ctx, testFileID, metadata)
+	if err != nil || m != nil {
+		t.Fatalf("Expected no manifest without a trust anchor, got %v, %v", m, err)
+	}
+
+	m, err = newTestDownloader(t, mockClient, WithTrustedRoot(trusted.RootHash)).fetchTrustedManifest(ctx, testFileID, metadata)
+	if err != nil || m != trusted {
+		t.Fatalf("Expected pinned manifest to verify, got %v", err)
+	}
+
+	_, err = newTestDownloader(t, mockClient, WithTrustedRoot(manifest.LeafHash(nil))).fetchTrustedManifest(ctx, testFileID, metadata)
+	if err == nil {
+		t.Fatalf("Expected manifest with a different root to be rejected")
+	}
+}
+
+func TestFetchManifest_Pages(t *testing.T) {
+	leaves := [][]byte{manifest.LeafHash([]byte("a")), manifest.LeafHash([]byte("b")), manifest.LeafHash([]byte("c"))}
+	root := manifest.RootHash(leaves)
+	page := func(start int, leaves ...[]byte) *pb.Manifest {
+		return &pb.Manifest{FileId: testFileID, TotalSize: 3, TotalChunks: 3, ChunkSize: 1, RootHash: root, StartChunk: int32(start), LeafHashes: leaves}
+	}
+	first, second := page(0, leaves[:2]...), page(2, leaves[2:]...)
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetManifest", mock.Anything, &pb.ManifestRequest{FileId: testFileID, ChunkSize: 1}).Return(first, nil).Once()
+	mockClient.On("GetManifest", mock.Anything, &pb.ManifestRequest{FileId: testFileID, ChunkSize: 1, StartChunk: 2}).Return(second, nil).Once()
+	m, err := fetchManifest(context.Background(), mockClient, testFileID, 1)
+	if err != nil {
+		t.Fatalf("Fetching a paged manifest failed: %v", err)
+	}
+	if err := manifest.Verify(m, root, nil); err != nil {
+		t.Fatalf("Expected the joined pages to verify, got %v", err)
+	}
+
+	// A page of a different tree is rejected
+	changed := page(2, leaves[2:]...)
+	changed.RootHash = manifest.LeafHash(nil)
+	mockClient.On("GetManifest", mock.Anything, &pb.ManifestRequest{FileId: testFileID, ChunkSize: 1}).Return(page(0, leaves[:2]...), nil).Once()
+	mockClient.On("GetManifest", mock.Anything, &pb.ManifestRequest{FileId: testFileID, ChunkSize: 1, StartChunk: 2}).Return(changed, nil).Once()
+	if _, err := fetchManifest(context.Background(), mockClient, testFileID, 1); err == nil {
+		t.Fatalf("Expected pages of different manifests to be rejected")
+	}
+}
+
+func TestDownloadFile_ChunkSizeMismatch(t *testing.T) {
+	mockClient := new(MockFileServiceClient)
+	mockStream := new(MockFileService_GetFileStreamClient)
+	data := make([]byte, 64*1024)
+	mockStream.On("Recv").Return(&pb.FileChunk{SequenceNumber: 0, ChunkData: data, ChunkSize: 64 * 1024, Checksum: fmt.Sprintf("%x", sha256.Sum256(data))}, nil).Once()
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(10), nil)
+	mockClient.On("GetFileStream", mock.Anything, mock.MatchedBy(func(req *pb.FileRequest) bool {
+		return req.ChunkSize == defaultChunkSize
+	})).Return(mockStream, nil)
+
+	d := newTestDownloader(t, mockClient, WithRetryPolicy(RetryPolicy{}))
+	err := d.Download(context.Background(), testFileID, filepath.Join(t.TempDir(), "out.bin"))
+	if err == nil {
+		t.Fatalf("Expected chunks of an unexpected size to be rejected")
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestDownloadFile_AtomicFinalize(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	stale := make([]byte, 3*defaultChunkSize)
+	for i := range stale {
+		stale[i] = 0xff
+	}
+	if err := os.WriteFile(dst, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partialPath(dst), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed run leaves dst alone
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(2), nil)
+	dropped := new(MockFileService_GetFileStreamClient)
+	dropped.On("Recv").Return(zeroChunk(0), nil).Once()
+	dropped.On("Recv").Return(&pb.FileChunk{}, errors.New("connection dropped")).Once()
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return(dropped, nil).Once()
+	if err := newTestDownloader(t, mockClient).Download(context.Background(), testFileID, dst); err == nil {
+		t.Fatalf("Expected the first run to fail")
+	}
+	if data, err := os.ReadFile(dst); err != nil || len(data) != len(stale) {
+		t.Errorf("Expected dst to be untouched by a failed download, got %d bytes, %v", len(data), err)
+	}
+
+	// A successful run replaces it with exactly the downloaded bytes
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return(chunkStream(zeroChunk(1)), nil).Once()
+	if err := newTestDownloader(t, mockClient).Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Size() != 2*defaultChunkSize {
+		t.Errorf("Expected a 2 chunk file, got %v, %v", info, err)
+	}
+	if _, err := os.Stat(partialPath(dst)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the partial file to be renamed, got %v", err)
+	}
+}
+
+func TestDownloadFile_InsufficientSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := util.FreeSpace(dir); err != nil {
+		t.Skipf("Free space cannot be checked here: %v", err)
+	}
+
+	huge := testMetadata(1)
+	huge.TotalSize = 1 << 62
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(huge, nil)
+
+	for _, sparse := range []bool{true, false} {
+		err := newTestDownloader(t, mockClient, WithSparse(sparse)).Download(context.Background(), testFileID, filepath.Join(dir, "out.bin"))
+		if !errors.Is(err, ErrInsufficientSpace) {
+			t.Fatalf("Expected ErrInsufficientSpace with sparse=%v, got %v", sparse, err)
+		}
+	}
+	mockClient.AssertNotCalled(t, "GetFileStream", mock.Anything, mock.Anything)
+}
+
+func TestDownloadFile_MultiStream(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	// Each stream fetches its own half of the file, the second one fails
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(4), nil)
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, EndChunk: 2, Sparse: true}).
+		Return(chunkStream(zeroChunk(0), zeroChunk(1)), nil).Once()
+	dropped := new(MockFileService_GetFileStreamClient)
+	dropped.On("Recv").Return(zeroChunk(2), nil).Once()
+	dropped.On("Recv").Return(&pb.FileChunk{}, errors.New("connection dropped")).Once()
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, StartChunk: 2, Sparse: true}).
+		Return(dropped, nil).Once()
+
+	// Only the range of the failed stream is fetched again
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, StartChunk: 3, Sparse: true}).
+		Return(chunkStream(zeroChunk(3)), nil).Once()
+
+	d := newTestDownloader(t, mockClient, WithStreams(2), WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	if err := d.Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestSplitGaps(t *testing.T) {
+	tests := []struct {
+		gaps [][2]int32
+		n    int
+		want [][][2]int32
+	}{
+		{[][2]int32{{0, 10}}, 1, [][][2]int32{{{0, 10}}}},
+		{[][2]int32{{0, 10}}, 3, [][][2]int32{{{0, 4}}, {{4, 8}}, {{8, 10}}}},
+		{[][2]int32{{0, 2}, {5, 9}}, 2, [][][2]int32{{{0, 2}, {5, 6}}, {{6, 9}}}},
+		{[][2]int32{{3, 5}}, 4, [][][2]int32{{{3, 4}}, {{4, 5}}}},
+	}
+	for _, tt := range tests {
+		if got := splitGaps(tt.gaps, tt.n); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("splitGaps(%v, %d) = %v, want %v", tt.gaps, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNew_InvalidConcurrency(t *testing.T) {
+	if _, err := New(WithClient(new(MockFileServiceClient)), WithConcurrency(0)); err == nil {
+		t.Fatalf("Expected a concurrency of 0 to be rejected")
+	}
+}
@@ -0,0 +1,162 @@
+// Command client downloads a file from the file server, or uploads one to it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/4erneff/alcatraz/client"
+	"github.com/4erneff/alcatraz/manifest"
+)
+
+const (
+	fileID     = "large_file.bin"
+	outputFile = "downloaded_file_parallel.mov"
+)
+
+// printProgress reports the download progress in steps of 10 percent
+func printProgress() client.ProgressFunc {
+	lastPercent := -1
+	return func(p client.Progress) {
+		if lastPercent < 0 {
+			fmt.Printf("Starting file download/resume, total size: %.2f MB, total chunks: %d\n", float64(p.TotalSize)/(1024*1024), p.TotalChunks)
+			lastPercent = 0
+		}
+		percent := int(float64(p.DownloadedChunks) / float64(p.TotalChunks) * 100)
+		if percent > lastPercent && percent%10 == 0 {
+			fmt.Printf("\rDownloading... %d%% complete, %d chunks queued for writing", percent, p.QueuedChunks)
+			lastPercent = percent
+		}
+	}
+}
+
+// parseSyncPolicy parses the -sync flag: none, chunk, complete or a number of chunks
+func parseSyncPolicy(value string) (client.SyncPolicy, error) {
+	switch value {
+	case "none":
+		return client.SyncPolicy{Mode: client.SyncNone}, nil
+	case "chunk":
+		return client.SyncPolicy{Mode: client.SyncEveryChunk}, nil
+	case "complete":
+		return client.SyncPolicy{Mode: client.SyncOnComplete}, nil
+	}
+	interval, err := strconv.Atoi(value)
+	if err != nil {
+		return client.SyncPolicy{}, fmt.Errorf("expected none, chunk, complete or a number of chunks, got %q", value)
+	}
+	return client.SyncPolicy{Mode: client.SyncInterval, Interval: interval}, nil
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:50051", "address of the file server")
+	certFile := flag.String("cert", "server.crt", "certificate the server is trusted with")
+	file := flag.String("file", fileID, "ID of the file to download or upload")
+	output := flag.String("output", outputFile, "path the file is downloaded to")
+	upload := flag.String("upload", "", "local file to upload instead of downloading")
+	pinnedRoot := flag.String("root", "", "hex encoded Merkle root every downloaded chunk must be verified against")
+	manifestKey := flag.String("manifest-pubkey", "", "PEM encoded Ed25519 public key the file manifest must be signed with")
+	maxAttempts := flag.Int("max-attempts", 0, "attempts before a failed transfer is given up, 0 for no limit")
+	maxElapsed := flag.Duration("max-elapsed", 0, "time after which a failing transfer is no longer retried, 0 for no limit")
+	chunkAttempts := flag.Int("chunk-attempts", 3, "times a corrupt chunk is fetched before the download fails")
+	resumeJournal := flag.Bool("journal", true, "persist progress in <output>.journal so an interrupted download resumes on the next run")
+	syncFlag := flag.String("sync", "16", "when written chunks are flushed to disk: every N chunks, chunk, complete or none")
+	writeQueue := flag.Int("write-queue", 8, "received chunks that may wait to be written before the download stops receiving")
+	streams := flag.Int("streams", 1, "number of streams the download is split across")
+	connections := flag.Int("connections", 1, "number of connections the streams are spread across")
+	sparse := flag.Bool("sparse", true, "receive all-zero chunks as markers and write them as holes")
+	codecs := flag.String("codecs", "zstd,gzip", "comma-separated compression codecs offered to the server, most preferred first, empty to disable compression")
+	window := flag.Int("window", 0, "download over the flow-controlled Transfer RPC with at most this many chunks in memory, 0 to use GetFileStream")
+	rangeOffset := flag.Int64("offset", 0, "first byte of a byte-range download")
+	rangeLength := flag.Int64("length", 0, "number of bytes of a byte-range download, 0 for the rest of the file")
+	flag.Parse()
+
+	syncPolicy, err := parseSyncPolicy(*syncFlag)
+	if err != nil {
+		log.Fatalf("Invalid -sync: %v", err)
+	}
+
+	retry := client.DefaultRetryPolicy
+	retry.MaxAttempts = *maxAttempts
+	retry.MaxElapsed = *maxElapsed
+
+	opts := []client.Option{
+		client.WithAddress(*addr),
+		client.WithCertFile(*certFile),
+		client.WithProgress(printProgress()),
+		client.WithRetryPolicy(retry),
+		client.WithMaxChunkAttempts(*chunkAttempts),
+		client.WithResumeJournal(*resumeJournal),
+		client.WithSyncPolicy(syncPolicy),
+		client.WithWriteQueue(*writeQueue),
+		client.WithStreams(*streams),
+		client.WithConnections(*connections),
+		client.WithTransferWindow(*window),
+		client.WithSparse(*sparse),
+		client.WithCodecs(parseCodecs(*codecs)...),
+	}
+	if *pinnedRoot != "" {
+		root, err := manifest.ParseRoot(*pinnedRoot)
+		if err != nil {
+			log.Fatalf("Invalid pinned root: %v", err)
+		}
+		opts = append(opts, client.WithTrustedRoot(root))
+	}
+	if *manifestKey != "" {
+		key, err := manifest.LoadPublicKey(*manifestKey)
+		if err != nil {
+			log.Fatalf("Failed to load manifest key: %v", err)
+		}
+		opts = append(opts, client.WithManifestKey(key))
+	}
+
+	downloader, err := client.New(opts...)
+	if err != nil {
+		log.Fatalf("Failed to start a connection: %v", err)
+	}
+	defer downloader.Close()
+
+	ctx := context.Background()
+
+	if *upload != "" {
+		if err := client.Upload(ctx, downloader.Client(), *file, *upload, retry); err != nil {
+			log.Fatalf("Failed to upload file: %v", err)
+		}
+		fmt.Println("File upload complete")
+		return
+	}
+
+	if *rangeOffset != 0 || *rangeLength != 0 {
+		out, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		defer out.Close()
+		n, err := downloader.DownloadRange(ctx, *file, *rangeOffset, *rangeLength, out)
+		if err != nil {
+			log.Fatalf("Failed to download range: %v", err)
+		}
+		fmt.Printf("Downloaded %d bytes starting at offset %d\n", n, *rangeOffset)
+		return
+	}
+
+	if err := downloader.Download(ctx, *file, *output); err != nil {
+		log.Fatalf("\nDownload failed: %v", err)
+	}
+	fmt.Println("\nFile download complete, SHA-256 verified")
+}
+
+// parseCodecs splits the -codecs flag into the codecs it lists
+func parseCodecs(s string) []string {
+	var codecs []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			codecs = append(codecs, name)
+		}
+	}
+	return codecs
+}
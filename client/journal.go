@@ -0,0 +1,274 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+)
+
+// ErrSourceChanged is returned when a download cannot be resumed because
+// the file on the server no longer matches its resume journal
+var ErrSourceChanged = errors.New("file changed on the server since the download started")
+
+// journalState is the on-disk form of a journal
+type journalState struct {
+	FileID    string `json:"file_id"`
+	TotalSize int64  `json:"total_size"`
+	ChunkSize int32  `json:"chunk_size"`
+	Checksum  string `json:"checksum"`
+	Verified  []byte `json:"verified"` // Bit i is set once chunk i has been verified, written and made durable
+
+	TransferIDs []string `json:"transfer_ids,omitempty"` // Flow-controlled transfer of each part of the download to reconnect to
+}
+
+// journal persists which chunks of a download have been verified and
+// written, so a later run can resume it. It lives next to the destination
+// as <dst>.journal. A journal without a path only tracks progress in memory.
+//
+// A chunk is only persisted as done once it is durable according to the
+// sync policy: checkpoints flush the written chunks to disk with sync before
+// they are recorded.
+type journal struct {
+	path   string
+	policy SyncPolicy
+	sync   func() error // Flushes the written chunks to disk, nil if there is nothing to flush
+
+	mu       sync.Mutex
+	state    journalState
+	written  []byte  // Bitmap of the chunks verified and written, durable or not
+	pending  []int32 // Chunks written since the last checkpoint, not durable yet
+	verified int32   // Number of bits set in written
+}
+
+// journalPath returns the path of the journal of a download into dst
+func journalPath(dst string) string {
+	return dst + ".journal"
+}
+
+// loadJournal reads the journal of a download into dst. It returns nil if
+// there is none.
+func loadJournal(dst string) (*journal, error) {
+	path := journalPath(dst)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{path: path, policy: DefaultSyncPolicy}
+	if err := json.Unmarshal(data, &j.state); err != nil {
+		return nil, fmt.Errorf("reading journal %s: %w", path, err)
+	}
+	if j.state.ChunkSize <= 0 || len(j.state.Verified) != bitmapSize(chunkCount(j.state.TotalSize, j.state.ChunkSize)) {
+		return nil, fmt.Errorf("reading journal %s: inconsistent chunk bitmap", path)
+	}
+	j.written = append([]byte(nil), j.state.Verified...)
+	for seq := int32(0); seq < chunkCount(j.state.TotalSize, j.state.ChunkSize); seq++ {
+		if j.isVerified(seq) {
+			j.verified++
+		}
+	}
+	return j, nil
+}
+
+// newJournal returns an empty journal of a download of the file described by metadata into dst
+func newJournal(dst string, fileID string, metadata *pb.FileMetadataResponse) *journal {
+	return &journal{
+		path:   journalPath(dst),
+		policy: DefaultSyncPolicy,
+		state: journalState{
+			FileID:    fileID,
+			TotalSize: metadata.TotalSize,
+			ChunkSize: metadata.ChunkSize,
+			Checksum:  metadata.FileChecksum,
+			Verified:  make([]byte, bitmapSize(metadata.TotalChunks)),
+		},
+		written: make([]byte, bitmapSize(metadata.TotalChunks)),
+	}
+}
+
+// matches returns ErrSourceChanged unless the journal was written for the
+// file the server describes with metadata
+func (j *journal) matches(fileID string, metadata *pb.FileMetadataResponse) error {
+	switch {
+	case j.state.FileID != fileID:
+		return fmt.Errorf("journal %s belongs to %s, not %s", j.path, j.state.FileID, fileID)
+	case j.state.TotalSize != metadata.TotalSize:
+		return fmt.Errorf("%w: size is %d bytes, journal recorded %d", ErrSourceChanged, metadata.TotalSize, j.state.TotalSize)
+	case j.state.Checksum != metadata.FileChecksum:
+		return fmt.Errorf("%w: SHA-256 is %s, journal recorded %s", ErrSourceChanged, metadata.FileChecksum, j.state.Checksum)
+	case j.state.ChunkSize != metadata.ChunkSize:
+		return fmt.Errorf("server uses %d byte chunks, journal recorded %d", metadata.ChunkSize, j.state.ChunkSize)
+	}
+	return nil
+}
+
+// bitmapSize returns the number of bytes of a bitmap with a bit per chunk
+func bitmapSize(totalChunks int32) int {
+	return int((totalChunks + 7) / 8)
+}
+
+// chunkCount returns the number of chunks a file of the given size is divided into
+func chunkCount(totalSize int64, chunkSize int32) int32 {
+	return int32((totalSize + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+// isVerified reports whether chunk seq has been verified and written. The
+// caller must hold j.mu or own the journal exclusively.
+func (j *journal) isVerified(seq int32) bool {
+	return j.written[seq/8]&(1<<(seq%8)) != 0
+}
+
+// verifiedChunk reports whether chunk seq has been verified and written
+func (j *journal) verifiedChunk(seq int32) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.isVerified(seq)
+}
+
+// durableChunk reports whether chunk seq has been recorded as durable by a checkpoint
+func (j *journal) durableChunk(seq int32) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state.Verified[seq/8]&(1<<(seq%8)) != 0
+}
+
+// gaps returns the runs [start, end) of chunks that have not been verified
+func (j *journal) gaps() [][2]int32 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var missing []int32
+	for seq := int32(0); seq < chunkCount(j.state.TotalSize, j.state.ChunkSize); seq++ {
+		if !j.isVerified(seq) {
+			missing = append(missing, seq)
+		}
+	}
+	return chunkRuns(missing)
+}
+
+// transferID returns the flow-controlled transfer part of the download reconnects to
+func (j *journal) transferID(part int) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if part >= len(j.state.TransferIDs) {
+		return ""
+	}
+	return j.state.TransferIDs[part]
+}
+
+// setTransferID records the flow-controlled transfer of part of the download
+func (j *journal) setTransferID(part int, id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for len(j.state.TransferIDs) <= part {
+		j.state.TransferIDs = append(j.state.TransferIDs, "")
+	}
+	j.state.TransferIDs[part] = id
+}
+
+// verifiedChunks returns the number of chunks that have been verified and written
+func (j *journal) verifiedChunks() int32 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.verified
+}
+
+// markVerified records that chunk seq has been verified and written, and
+// writes a checkpoint when the sync policy asks for one
+func (j *journal) markVerified(seq int32) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.isVerified(seq) {
+		return nil
+	}
+	j.written[seq/8] |= 1 << (seq % 8)
+	j.verified++
+	j.pending = append(j.pending, seq)
+
+	switch j.policy.Mode {
+	case SyncEveryChunk:
+		return j.checkpointLocked()
+	case SyncInterval:
+		if len(j.pending) >= j.policy.Interval {
+			return j.checkpointLocked()
+		}
+	}
+	return nil
+}
+
+// save writes a checkpoint of the journal to disk. Unless the sync policy
+// only syncs on completion or never syncs, the chunks written since the last
+// checkpoint are made durable and recorded first; otherwise they are never
+// recorded.
+func (j *journal) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.policy.Mode == SyncOnComplete || j.policy.Mode == SyncNone {
+		return j.saveLocked()
+	}
+	return j.checkpointLocked()
+}
+
+// checkpointLocked flushes the pending chunks to disk, records them as done
+// and saves the journal. The caller must hold j.mu.
+func (j *journal) checkpointLocked() error {
+	if len(j.pending) > 0 && j.path != "" && j.sync != nil {
+		if err := j.sync(); err != nil {
+			return fmt.Errorf("syncing written chunks: %w", err)
+		}
+	}
+	for _, seq := range j.pending {
+		j.state.Verified[seq/8] |= 1 << (seq % 8)
+	}
+	j.pending = j.pending[:0]
+	return j.saveLocked()
+}
+
+// saveLocked replaces the journal on disk through a temporary file, so a
+// crash leaves either the previous or the new checkpoint behind. It only
+// records chunks that were made durable.
+func (j *journal) saveLocked() error {
+	if j.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(j.state)
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// remove deletes the journal once the download no longer needs it
+func (j *journal) remove() error {
+	if j.path == "" {
+		return nil
+	}
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// chunkRuns groups ascending sequence numbers into runs [start, end) of consecutive chunks
+func chunkRuns(seqs []int32) [][2]int32 {
+	var runs [][2]int32
+	for _, seq := range seqs {
+		if n := len(runs); n > 0 && runs[n-1][1] == seq {
+			runs[n-1][1]++
+			continue
+		}
+		runs = append(runs, [2]int32{seq, seq + 1})
+	}
+	return runs
+}
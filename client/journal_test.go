@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDownloadFile_ResumeAfterRestart(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	// The first run dies after two of four chunks
+	first := new(MockFileServiceClient)
+	first.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(4), nil)
+	dropped := new(MockFileService_GetFileStreamClient)
+	dropped.On("Recv").Return(zeroChunk(0), nil).Once()
+	dropped.On("Recv").Return(zeroChunk(1), nil).Once()
+	dropped.On("Recv").Return(&pb.FileChunk{}, errors.New("connection dropped")).Once()
+	first.On("GetFileStream", mock.Anything, mock.Anything).Return(dropped, nil)
+
+	if err := newTestDownloader(t, first).Download(context.Background(), testFileID, dst); err == nil {
+		t.Fatalf("Expected the first run to fail")
+	}
+	if _, err := os.Stat(journalPath(dst)); err != nil {
+		t.Fatalf("Expected a resume journal after the failed run: %v", err)
+	}
+
+	// A new Downloader picks up at the first chunk the journal does not hold
+	second := new(MockFileServiceClient)
+	second.On("GetFileMetadata", mock.Anything, &pb.FileMetadataRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Checksum: true}).Return(testMetadata(4), nil)
+	second.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, StartChunk: 2, ChunkSize: defaultChunkSize, Sparse: true}).
+		Return(chunkStream(zeroChunk(2), zeroChunk(3)), nil).Once()
+
+	if err := newTestDownloader(t, second).Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Expected the download to resume, got %v", err)
+	}
+	if _, err := os.Stat(journalPath(dst)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the journal to be removed after a verified download, got %v", err)
+	}
+	second.AssertExpectations(t)
+}
+
+func TestDownloadFile_ResumeSourceChanged(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	j := newJournal(dst, testFileID, testMetadata(4))
+	if err := j.markVerified(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partialPath(dst), make([]byte, defaultChunkSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := testMetadata(4)
+	changed.FileChecksum = "0123"
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(changed, nil)
+
+	err := newTestDownloader(t, mockClient).Download(context.Background(), testFileID, dst)
+	if !errors.Is(err, ErrSourceChanged) {
+		t.Fatalf("Expected ErrSourceChanged, got %v", err)
+	}
+	mockClient.AssertNotCalled(t, "GetFileStream", mock.Anything, mock.Anything)
+}
+
+func TestDownloadFile_WithoutJournal(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(2), nil)
+	stream := new(MockFileService_GetFileStreamClient)
+	stream.On("Recv").Return(zeroChunk(0), nil).Once()
+	stream.On("Recv").Return(&pb.FileChunk{}, io.ErrUnexpectedEOF).Once()
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return(stream, nil)
+
+	if err := newTestDownloader(t, mockClient, WithResumeJournal(false)).Download(context.Background(), testFileID, dst); err == nil {
+		t.Fatalf("Expected the download to fail")
+	}
+	if _, err := os.Stat(journalPath(dst)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no journal, got %v", err)
+	}
+}
+
+func TestLoadJournal(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+	if j, err := loadJournal(dst); j != nil || err != nil {
+		t.Fatalf("Expected no journal, got %v, %v", j, err)
+	}
+
+	j := newJournal(dst, testFileID, testMetadata(10))
+	for _, seq := range []int32{0, 1, 9} {
+		if err := j.markVerified(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadJournal(dst)
+	if err != nil {
+		t.Fatalf("Failed to load journal: %v", err)
+	}
+	if loaded.verifiedChunks() != 3 || fmt.Sprint(loaded.gaps()) != "[[2 9]]" || !loaded.verifiedChunk(9) {
+		t.Errorf("Expected chunks 0, 1 and 9 to be verified, got %08b", loaded.state.Verified)
+	}
+	if err := loaded.matches(testFileID, testMetadata(10)); err != nil {
+		t.Errorf("Expected the journal to match its file, got %v", err)
+	}
+
+	if err := os.WriteFile(journalPath(dst), []byte(`{"chunk_size":1,"total_size":100,"verified":"AA=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadJournal(dst); err == nil {
+		t.Errorf("Expected a journal with a short bitmap to be rejected")
+	}
+}
+
+func TestJournal_SyncPolicy(t *testing.T) {
+	tests := []struct {
+		policy  SyncPolicy
+		syncs   int    // Flushes after marking chunks 0 to 2
+		durable string // Bitmap recorded on disk after marking chunks 0 to 2
+		saved   string // Bitmap recorded on disk after a checkpoint
+	}{
+		{SyncPolicy{Mode: SyncEveryChunk}, 3, "[7]", "[7]"},
+		{SyncPolicy{Mode: SyncInterval, Interval: 2}, 1, "[3]", "[7]"},
+		{SyncPolicy{Mode: SyncOnComplete}, 0, "[0]", "[0]"},
+		{SyncPolicy{Mode: SyncNone}, 0, "[0]", "[0]"},
+	}
+	for _, tt := range tests {
+		dst := filepath.Join(t.TempDir(), "out.bin")
+		j := newJournal(dst, testFileID, testMetadata(4))
+		j.policy = tt.policy
+		syncs := 0
+		j.sync = func() error {
+			syncs++
+			return nil
+		}
+
+		for seq := int32(0); seq < 3; seq++ {
+			if err := j.markVerified(seq); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if syncs != tt.syncs || fmt.Sprint(j.state.Verified) != tt.durable {
+			t.Errorf("Mode %d: expected %d flushes recording %s, got %d recording %v", tt.policy.Mode, tt.syncs, tt.durable, syncs, j.state.Verified)
+		}
+		if j.verifiedChunks() != 3 || fmt.Sprint(j.gaps()) != "[[3 4]]" {
+			t.Errorf("Mode %d: expected written chunks to stay done for this run, got gaps %v", tt.policy.Mode, j.gaps())
+		}
+
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadJournal(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(loaded.state.Verified) != tt.saved {
+			t.Errorf("Mode %d: expected a checkpoint to record %s, got %v", tt.policy.Mode, tt.saved, loaded.state.Verified)
+		}
+	}
+}
+
+func TestDownloadFile_OutOfOrderGaps(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	// Chunks arrive out of order and the stream drops before chunks 1 and 2
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(5), nil)
+	dropped := new(MockFileService_GetFileStreamClient)
+	dropped.On("Recv").Return(zeroChunk(0), nil).Once()
+	dropped.On("Recv").Return(zeroChunk(3), nil).Once()
+	dropped.On("Recv").Return(&pb.FileChunk{}, errors.New("connection dropped")).Once()
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Sparse: true}).Return(dropped, nil).Once()
+
+	// Only the holes are fetched again, [1, 3) and the tail from chunk 4 on one stream
+	holes := []*pb.ChunkRange{{StartChunk: 1, EndChunk: 3}, {StartChunk: 4, EndChunk: 5}}
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, ChunkSize: defaultChunkSize, Ranges: holes, Sparse: true}).
+		Return(chunkStream(zeroChunk(1), zeroChunk(2), zeroChunk(4)), nil).Once()
+
+	d := newTestDownloader(t, mockClient, WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	if err := d.Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Expected the gaps to be filled, got %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestChunkRuns(t *testing.T) {
+	runs := chunkRuns([]int32{1, 2, 3, 7, 9, 10})
+	expected := [][2]int32{{1, 4}, {7, 8}, {9, 11}}
+	if fmt.Sprint(runs) != fmt.Sprint(expected) {
+		t.Errorf("Expected runs %v, got %v", expected, runs)
+	}
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+)
+
+const (
+	defaultServerAddr       = "localhost:50051"
+	defaultCertFile         = "server.crt"
+	defaultChunkSize        = 1024 * 1024 // Chunk size asked from the server, which reports the size it actually uses
+	defaultConcurrency      = 4           // Number of parallel file descriptors and write workers
+	defaultWriteQueue       = 8           // Received chunks that may wait for a write worker
+	defaultMaxChunkAttempts = 3           // Times a chunk may fail before the download is given up
+)
+
+// RetryPolicy controls how a failed transfer is resumed. Only errors that
+// retrying can fix are retried: a NotFound, PermissionDenied or DataLoss
+// status, for example, fails the transfer at once. The pause between two
+// attempts starts at Delay and doubles after every failed attempt up to
+// MaxDelay; a pause the server asks for with a RetryInfo detail takes
+// precedence. An attempt of a download that received chunks before it failed
+// starts the count, the pause and the elapsed time over.
+type RetryPolicy struct {
+	MaxAttempts int           // Number of attempts before giving up, 0 for no limit
+	MaxElapsed  time.Duration // Time since the first attempt after which no retry is started, 0 for no limit
+	Delay       time.Duration // Pause before the first retry
+	MaxDelay    time.Duration // Upper bound of the growing pause, 0 to always pause for Delay
+	Jitter      float64       // Fraction of the pause randomized to spread out clients retrying together, between 0 and 1
+}
+
+// DefaultRetryPolicy retries without limit, pausing for 1 second at first
+// and up to a minute as failures continue
+var DefaultRetryPolicy = RetryPolicy{Delay: time.Second, MaxDelay: time.Minute, Jitter: 0.2}
+
+// SyncMode selects when the chunks written by a download are flushed to disk
+type SyncMode int
+
+const (
+	// SyncInterval flushes the written chunks every SyncPolicy.Interval chunks
+	SyncInterval SyncMode = iota
+	// SyncEveryChunk flushes every chunk as soon as it has been written
+	SyncEveryChunk
+	// SyncOnComplete only flushes the finished file, so an interrupted
+	// download cannot resume the chunks it wrote
+	SyncOnComplete
+	// SyncNone never flushes the written chunks, which are therefore never
+	// recorded in the journal; an interrupted download starts over
+	SyncNone
+)
+
+// SyncPolicy controls how written chunks are made durable. A chunk only
+// counts as done in the resume journal once it is durable, so every flush is
+// followed by a journal checkpoint.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval int // Chunks between two flushes in SyncInterval mode
+}
+
+// DefaultSyncPolicy flushes the written chunks every 16 chunks
+var DefaultSyncPolicy = SyncPolicy{Mode: SyncInterval, Interval: 16}
+
+// Progress describes how far a download has come
+type Progress struct {
+	FileID           string
+	DownloadedChunks int32 // Chunks verified and written so far, including those of earlier runs
+	TotalChunks      int32
+	TotalSize        int64
+	QueuedChunks     int // Received chunks waiting to be written
+}
+
+// ProgressFunc is called after every verified chunk, never concurrently. It must not block.
+type ProgressFunc func(Progress)
+
+// Option configures a Downloader
+type Option func(*Downloader)
+
+// WithAddress sets the address of the server to dial, localhost:50051 by default
+func WithAddress(addr string) Option {
+	return func(d *Downloader) { d.addr = addr }
+}
+
+// WithCertFile sets the certificate the server is trusted with, server.crt by default
+func WithCertFile(path string) Option {
+	return func(d *Downloader) { d.certFile = path }
+}
+
+// WithClient makes the Downloader use an existing client instead of dialing the server
+func WithClient(client pb.FileServiceClient) Option {
+	return func(d *Downloader) { d.client = client }
+}
+
+// WithDestinationDir sets the directory relative download destinations are resolved against
+func WithDestinationDir(dir string) Option {
+	return func(d *Downloader) { d.destDir = dir }
+}
+
+// WithConcurrency sets the number of file descriptors and workers chunks are
+// written through, 4 by default
+func WithConcurrency(n int) Option {
+	return func(d *Downloader) { d.concurrency = n }
+}
+
+// WithWriteQueue sets how many received chunks may wait for a write worker,
+// 8 by default. Once the queue is full the download stops receiving until a
+// worker catches up, which bounds memory when the disk is slower than the
+// network.
+func WithWriteQueue(n int) Option {
+	return func(d *Downloader) { d.writeQueue = n }
+}
+
+// WithStreams sets the number of streams the chunks of a download are
+// fetched on in parallel, 1 by default. Each stream fetches its own share of
+// the chunks still missing.
+func WithStreams(n int) Option {
+	return func(d *Downloader) { d.streams = n }
+}
+
+// WithConnections sets the number of connections New dials and spreads the
+// streams across, 1 by default. It has no effect with WithClient.
+func WithConnections(n int) Option {
+	return func(d *Downloader) { d.connections = n }
+}
+
+// WithChunkSize sets the chunk size asked from the server
+func WithChunkSize(size int32) Option {
+	return func(d *Downloader) { d.chunkSize = size }
+}
+
+// WithRetryPolicy sets how failed downloads are resumed
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(d *Downloader) { d.retry = policy }
+}
+
+// WithMaxChunkAttempts sets how often a single chunk may fail verification
+// or its write before the download fails, 3 by default
+func WithMaxChunkAttempts(n int) Option {
+	return func(d *Downloader) { d.maxChunkAttempts = n }
+}
+
+// WithResumeJournal sets whether progress is persisted in <dst>.journal so a
+// later Download can resume an interrupted one, enabled by default
+func WithResumeJournal(enabled bool) Option {
+	return func(d *Downloader) { d.journal = enabled }
+}
+
+// WithTransferWindow downloads through the flow-controlled Transfer RPC,
+// holding at most window chunks in memory at a time. 0, the default, uses
+// GetFileStream.
+func WithTransferWindow(window int) Option {
+	return func(d *Downloader) { d.window = window }
+}
+
+// WithSparse sets whether the server may send all-zero chunks as markers,
+// which are written as holes instead of data, enabled by default. A sparse
+// download reserves no space up front, so the holes stay unallocated.
+func WithSparse(enabled bool) Option {
+	return func(d *Downloader) { d.sparse = enabled }
+}
+
+// WithCodecs sets the compression codecs offered to the server, most
+// preferred first. The server compresses a chunk with the first one it
+// supports, unless that does not shrink it. By default every codec of
+// codec.Supported is offered; no codecs turn compression off.
+func WithCodecs(codecs ...string) Option {
+	return func(d *Downloader) { d.codecs = codecs }
+}
+
+// WithSyncPolicy sets how written chunks are made durable, DefaultSyncPolicy by default
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(d *Downloader) { d.sync = policy }
+}
+
+// WithProgress sets a callback reporting download progress
+func WithProgress(fn ProgressFunc) Option {
+	return func(d *Downloader) { d.progress = fn }
+}
+
+// WithTrustedRoot requires every chunk to be verified against a manifest with this Merkle root
+func WithTrustedRoot(root []byte) Option {
+	return func(d *Downloader) { d.trustedRoot = root }
+}
+
+// WithManifestKey requires every chunk to be verified against a manifest signed with this key
+func WithManifestKey(key ed25519.PublicKey) Option {
+	return func(d *Downloader) { d.manifestKey = key }
+}
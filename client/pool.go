@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+)
+
+// writeJob is a received chunk waiting to be verified and written
+type writeJob struct {
+	chunk *pb.FileChunk
+	done  func(err error) // Called by the worker once the chunk has been handled
+}
+
+// writePool verifies and writes the received chunks of a download through a
+// fixed number of workers. Its queue is bounded, so the streams stop
+// receiving once the disk falls behind instead of buffering chunks in memory.
+type writePool struct {
+	queue chan writeJob
+	wg    sync.WaitGroup
+}
+
+// startWritePool starts d.concurrency workers writing the chunks of t
+func (d *Downloader) startWritePool(t *transfer) *writePool {
+	p := &writePool{queue: make(chan writeJob, d.writeQueue)}
+	for i := 0; i < d.concurrency; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.queue {
+				job.done(d.handleChunk(t, job.chunk))
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a chunk, blocking while the queue is full
+func (p *writePool) submit(ctx context.Context, job writeJob) error {
+	select {
+	case p.queue <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// depth returns the number of chunks waiting for a worker
+func (p *writePool) depth() int {
+	return len(p.queue)
+}
+
+// close stops the workers once the queued chunks have been handled
+func (p *writePool) close() {
+	close(p.queue)
+	p.wg.Wait()
+}
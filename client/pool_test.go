@@ -0,0 +1,25 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWritePool_Backpressure(t *testing.T) {
+	p := &writePool{queue: make(chan writeJob, 1)} // No workers drain the queue
+
+	if err := p.submit(context.Background(), writeJob{chunk: zeroChunk(0)}); err != nil {
+		t.Fatalf("Expected the first chunk to be queued, got %v", err)
+	}
+	if depth := p.depth(); depth != 1 {
+		t.Errorf("Expected a queue depth of 1, got %d", depth)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.submit(ctx, writeJob{chunk: zeroChunk(1)}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected submit to block while the queue is full, got %v", err)
+	}
+}
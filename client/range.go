@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/4erneff/alcatraz/client/util"
+	"github.com/4erneff/alcatraz/codec"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/synthetic"
+)
+
+// DownloadRange writes length bytes of the file starting at offset to w. A
+// length of 0 reads until the end of the file. It returns the number of bytes
+// written.
+func (d *Downloader) DownloadRange(ctx context.Context, fileID string, offset, length int64, w io.Writer) (int64, error) {
+	req := &pb.FileRequest{
+		FileId: fileID,
+		Offset: offset,
+		Length: length,
+		Sparse: d.sparse,
+		Codecs: d.codecs,
+	}
+	if offset == 0 && length == 0 {
+		// The whole file, which the server streams in chunk mode
+		req = &pb.FileRequest{FileId: fileID, Sparse: d.sparse, Codecs: d.codecs}
+	}
+
+	expected, _ := synthetic.Parse(fileID) // nil unless fileID names a synthetic file
+
+	stream, err := d.client.GetFileStream(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	next := offset
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return next - offset, err
+		}
+
+		if chunk.Offset != next {
+			return next - offset, fmt.Errorf("expected data at offset %d, got offset %d", next, chunk.Offset)
+		}
+		data := chunk.ChunkData
+		if chunk.Codec != codec.None {
+			if data, err = codec.Decompress(chunk.Codec, data, int(chunk.ChunkSize)); err != nil {
+				return next - offset, fmt.Errorf("decompressing data at offset %d: %w", chunk.Offset, err)
+			}
+		}
+		if len(data) == 0 && chunk.ZeroLength > 0 {
+			data = make([]byte, chunk.ZeroLength) // A writer cannot skip, so the zeros are written out
+		} else if !util.VerifyChecksum(data, chunk.Checksum) {
+			return next - offset, fmt.Errorf("checksum mismatch on data at offset %d", chunk.Offset)
+		}
+		if expected != nil {
+			if err := verifySynthetic(expected, data, chunk.Offset); err != nil {
+				return next - offset, err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return next - offset, err
+		}
+		next += int64(len(data))
+	}
+
+	if length > 0 && next-offset != length {
+		return next - offset, fmt.Errorf("received %d of %d requested bytes", next-offset, length)
+	}
+	return next - offset, nil
+}
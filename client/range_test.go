@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/4erneff/alcatraz/client/util"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/stretchr/testify/mock"
+)
+
+func rangeChunk(seq int32, offset int64, data string) *pb.FileChunk {
+	return &pb.FileChunk{SequenceNumber: seq, Offset: offset, ChunkData: []byte(data), Checksum: util.Checksum([]byte(data))}
+}
+
+func TestDownloadRange(t *testing.T) {
+	mockClient := new(MockFileServiceClient)
+	mockStream := new(MockFileService_GetFileStreamClient)
+	mockStream.On("Recv").Return(rangeChunk(0, 6, "ab"), nil).Once()
+	mockStream.On("Recv").Return(rangeChunk(1, 8, "cdef"), nil).Once()
+	mockStream.On("Recv").Return(&pb.FileChunk{}, io.EOF)
+	mockClient.On("GetFileStream", mock.Anything, &pb.FileRequest{FileId: testFileID, Offset: 6, Length: 6, Sparse: true}).Return(mockStream, nil)
+
+	var out bytes.Buffer
+	n, err := newTestDownloader(t, mockClient).DownloadRange(context.Background(), testFileID, 6, 6, &out)
+	if err != nil {
+		t.Fatalf("downloadRange failed: %v", err)
+	}
+	if n != 6 || out.String() != "abcdef" {
+		t.Errorf("Expected 6 bytes \"abcdef\", got %d bytes %q", n, out.String())
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestDownloadRange_Gap(t *testing.T) {
+	mockClient := new(MockFileServiceClient)
+	mockStream := new(MockFileService_GetFileStreamClient)
+	mockStream.On("Recv").Return(rangeChunk(0, 6, "ab"), nil).Once()
+	mockStream.On("Recv").Return(rangeChunk(1, 9, "def"), nil).Once()
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return(mockStream, nil)
+
+	var out bytes.Buffer
+	if _, err := newTestDownloader(t, mockClient).DownloadRange(context.Background(), testFileID, 6, 6, &out); err == nil {
+		t.Fatalf("Expected a gap in the received data to be reported")
+	}
+}
+
+func TestDownloadRange_Short(t *testing.T) {
+	mockClient := new(MockFileServiceClient)
+	mockStream := new(MockFileService_GetFileStreamClient)
+	mockStream.On("Recv").Return(rangeChunk(0, 6, "ab"), nil).Once()
+	mockStream.On("Recv").Return(&pb.FileChunk{}, io.EOF)
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return(mockStream, nil)
+
+	var out bytes.Buffer
+	if _, err := newTestDownloader(t, mockClient).DownloadRange(context.Background(), testFileID, 6, 6, &out); err == nil {
+		t.Fatalf("Expected a short range to be reported")
+	}
+}
@@ -0,0 +1,421 @@
+// Package remote gives random access to files served by the file service.
+//
+// A RemoteFile implements io.ReaderAt and io.ReadSeeker on top of
+// GetFileMetadata and ranged GetFileStream calls. Chunks are verified against
+// their checksums, kept in a bounded LRU cache and, after a read, the chunks
+// that follow are fetched in the background so sequential readers rarely wait
+// for the network.
+package remote
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/4erneff/alcatraz/client/util"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+)
+
+const (
+	defaultCacheChunks = 16
+	defaultReadAhead   = 2
+)
+
+var (
+	_ io.ReaderAt   = (*RemoteFile)(nil)
+	_ io.ReadSeeker = (*RemoteFile)(nil)
+)
+
+// ErrClosed is returned by reads on a closed RemoteFile
+var ErrClosed = errors.New("remote: file already closed")
+
+// Options tune a RemoteFile. The zero value selects the defaults.
+type Options struct {
+	ChunkSize   int32 // Requested chunk size, 0 for the server default
+	CacheChunks int   // Number of chunks kept in memory, 16 if 0
+	ReadAhead   int   // Number of chunks fetched ahead of the last read, 2 if 0, negative to disable
+}
+
+// RemoteFile is a read-only view of a file on the server
+type RemoteFile struct {
+	client    pb.FileServiceClient
+	fileID    string
+	size      int64
+	chunkSize int32
+
+	checksumMu sync.Mutex
+	checksum   string // SHA-256 of the whole file, fetched on first use
+
+	ctx    context.Context // Cancelled by Close, bounds every fetch
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	offset    int64 // Position used by Read and Seek
+	cache     *chunkCache
+	pending   map[int32]*pendingChunk // Chunks being fetched
+	readAhead int
+}
+
+// pendingChunk is a chunk whose fetch is in flight
+type pendingChunk struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// Open describes fileID with GetFileMetadata and returns a RemoteFile for it.
+// ctx bounds the lifetime of the file; reads fail once it is cancelled.
+func Open(ctx context.Context, client pb.FileServiceClient, fileID string, opts *Options) (*RemoteFile, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	metadata, err := client.GetFileMetadata(ctx, &pb.FileMetadataRequest{FileId: fileID, ChunkSize: opts.ChunkSize})
+	if err != nil {
+		return nil, err
+	}
+
+	cacheChunks := opts.CacheChunks
+	if cacheChunks <= 0 {
+		cacheChunks = defaultCacheChunks
+	}
+	readAhead := opts.ReadAhead
+	if readAhead == 0 {
+		readAhead = defaultReadAhead
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &RemoteFile{
+		client:    client,
+		fileID:    fileID,
+		size:      metadata.TotalSize,
+		chunkSize: metadata.ChunkSize,
+		ctx:       ctx,
+		cancel:    cancel,
+		cache:     newChunkCache(cacheChunks),
+		pending:   make(map[int32]*pendingChunk),
+		readAhead: readAhead,
+	}, nil
+}
+
+// Size returns the size of the file in bytes
+func (f *RemoteFile) Size() int64 {
+	return f.size
+}
+
+// Checksum returns the SHA-256 of the whole file as reported by the server.
+// The server has to read the whole file to compute it, so it is only asked
+// for on the first call rather than by Open.
+func (f *RemoteFile) Checksum(ctx context.Context) (string, error) {
+	f.checksumMu.Lock()
+	defer f.checksumMu.Unlock()
+	if f.checksum != "" {
+		return f.checksum, nil
+	}
+	metadata, err := f.client.GetFileMetadata(ctx, &pb.FileMetadataRequest{FileId: f.fileID, ChunkSize: f.chunkSize, Checksum: true})
+	if err != nil {
+		return "", err
+	}
+	if metadata.TotalSize != f.size {
+		return "", fmt.Errorf("remote: %s changed from %d to %d bytes", f.fileID, f.size, metadata.TotalSize)
+	}
+	f.checksum = metadata.FileChecksum
+	return f.checksum, nil
+}
+
+// Stat returns a description of the file
+func (f *RemoteFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{name: path.Base(f.fileID), size: f.size}, nil
+}
+
+// Close stops background fetches. Reads after Close return ErrClosed.
+func (f *RemoteFile) Close() error {
+	f.cancel()
+	return nil
+}
+
+// ReadAt reads len(p) bytes starting at off. It returns io.EOF when the read
+// stops at the end of the file.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("remote: negative offset %d", off)
+	}
+	if f.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	if end == off {
+		return 0, nil
+	}
+
+	first := int32(off / int64(f.chunkSize))
+	last := int32((end - 1) / int64(f.chunkSize))
+	chunks, err := f.chunks(first, last)
+	if err != nil {
+		return 0, err
+	}
+	f.prefetch(last + 1)
+
+	n := 0
+	for i, data := range chunks {
+		chunkStart := int64(first+int32(i)) * int64(f.chunkSize)
+		from := off + int64(n) - chunkStart
+		n += copy(p[n:end-off], data[from:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads from the current position and advances it
+func (f *RemoteFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	offset := f.offset
+	f.mu.Unlock()
+
+	n, err := f.ReadAt(p, offset)
+	if err == io.EOF && n > 0 {
+		err = nil // Report EOF on the next call, as io.Reader expects
+	}
+
+	f.mu.Lock()
+	f.offset = offset + int64(n)
+	f.mu.Unlock()
+	return n, err
+}
+
+// Seek sets the position for the next Read
+func (f *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("remote: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("remote: negative position %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// chunks returns the data of chunks [first, last], fetching the ones that are
+// neither cached nor already in flight
+func (f *RemoteFile) chunks(first, last int32) ([][]byte, error) {
+	waits := make([]*pendingChunk, 0, last-first+1)
+	f.mu.Lock()
+	for i := first; i <= last; i++ {
+		if data, ok := f.cache.get(i); ok {
+			waits = append(waits, &pendingChunk{data: data})
+			continue
+		}
+		waits = append(waits, f.startFetchLocked(i, last))
+	}
+	f.mu.Unlock()
+
+	chunks := make([][]byte, len(waits))
+	for i, wait := range waits {
+		if wait.done != nil {
+			select {
+			case <-wait.done:
+			case <-f.ctx.Done():
+				return nil, ErrClosed
+			}
+		}
+		if wait.err != nil {
+			return nil, wait.err
+		}
+		chunks[i] = wait.data
+	}
+	return chunks, nil
+}
+
+// prefetch starts fetching the read-ahead window that begins at chunk next
+func (f *RemoteFile) prefetch(next int32) {
+	if f.readAhead <= 0 {
+		return
+	}
+	totalChunks := int32((f.size + int64(f.chunkSize) - 1) / int64(f.chunkSize))
+	last := next + int32(f.readAhead) - 1
+	if last >= totalChunks {
+		last = totalChunks - 1
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := next; i <= last; i++ {
+		if !f.cache.contains(i) {
+			f.startFetchLocked(i, last)
+		}
+	}
+}
+
+// startFetchLocked returns the pending fetch of chunk i, starting one that
+// covers the run of missing chunks [i, last] if none is in flight. f.mu must
+// be held.
+func (f *RemoteFile) startFetchLocked(i, last int32) *pendingChunk {
+	if pending, ok := f.pending[i]; ok {
+		return pending
+	}
+
+	end := i
+	for end < last && !f.cache.contains(end+1) && f.pending[end+1] == nil {
+		end++
+	}
+	run := make([]*pendingChunk, 0, end-i+1)
+	for j := i; j <= end; j++ {
+		pending := &pendingChunk{done: make(chan struct{})}
+		f.pending[j] = pending
+		run = append(run, pending)
+	}
+	go f.fetch(i, run)
+	return run[0]
+}
+
+// fetch streams the chunks [first, first+len(run)) and completes their
+// pending entries in order. If the stream fails, the remaining entries fail
+// with the same error.
+func (f *RemoteFile) fetch(first int32, run []*pendingChunk) {
+	err := f.fetchRun(first, run)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, pending := range run {
+		if pending.data == nil && pending.err == nil {
+			pending.err = err
+			if pending.err == nil {
+				pending.err = fmt.Errorf("remote: chunk %d missing from the stream", first+int32(i))
+			}
+			close(pending.done)
+		}
+		delete(f.pending, first+int32(i))
+	}
+}
+
+func (f *RemoteFile) fetchRun(first int32, run []*pendingChunk) error {
+	stream, err := f.client.GetFileStream(f.ctx, &pb.FileRequest{
+		FileId:     f.fileID,
+		StartChunk: first,
+		EndChunk:   first + int32(len(run)),
+		ChunkSize:  f.chunkSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range run {
+		chunk, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := f.checkChunk(first+int32(i), chunk); err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		f.cache.add(chunk.SequenceNumber, chunk.ChunkData)
+		run[i].data = chunk.ChunkData
+		close(run[i].done)
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// checkChunk verifies that a received chunk is the one expected and intact
+func (f *RemoteFile) checkChunk(expected int32, chunk *pb.FileChunk) error {
+	if chunk.TotalSize != f.size || chunk.ChunkSize != f.chunkSize {
+		return fmt.Errorf("remote: %s changed on the server", f.fileID)
+	}
+	if chunk.SequenceNumber != expected {
+		return fmt.Errorf("remote: expected chunk %d, got chunk %d", expected, chunk.SequenceNumber)
+	}
+	wantSize := f.size - int64(expected)*int64(f.chunkSize)
+	if wantSize > int64(f.chunkSize) {
+		wantSize = int64(f.chunkSize)
+	}
+	if int64(len(chunk.ChunkData)) != wantSize {
+		return fmt.Errorf("remote: chunk %d has %d bytes, expected %d", expected, len(chunk.ChunkData), wantSize)
+	}
+	if !util.VerifyChecksum(chunk.ChunkData, chunk.Checksum) {
+		return fmt.Errorf("remote: checksum mismatch on chunk %d", expected)
+	}
+	return nil
+}
+
+// chunkCache is a fixed-size LRU cache of chunk data
+type chunkCache struct {
+	capacity int
+	order    *list.List // Front is the most recently used chunk
+	entries  map[int32]*list.Element
+}
+
+type cacheEntry struct {
+	index int32
+	data  []byte
+}
+
+func newChunkCache(capacity int) *chunkCache {
+	return &chunkCache{capacity: capacity, order: list.New(), entries: make(map[int32]*list.Element)}
+}
+
+func (c *chunkCache) get(index int32) ([]byte, bool) {
+	elem, ok := c.entries[index]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+func (c *chunkCache) contains(index int32) bool {
+	_, ok := c.entries[index]
+	return ok
+}
+
+func (c *chunkCache) add(index int32, data []byte) {
+	if elem, ok := c.entries[index]; ok {
+		elem.Value.(*cacheEntry).data = data
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[index] = c.order.PushFront(&cacheEntry{index: index, data: data})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).index)
+	}
+}
+
+// fileInfo implements fs.FileInfo for a RemoteFile
+type fileInfo struct {
+	name string
+	size int64
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() any           { return nil }
@@ -0,0 +1,215 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/4erneff/alcatraz/client/util"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// fakeClient serves a single in-memory file the way the server does
+type fakeClient struct {
+	pb.FileServiceClient
+	data      []byte
+	chunkSize int32
+
+	mu       sync.Mutex
+	requests []*pb.FileRequest
+	corrupt  int32 // Chunk whose checksum is broken, -1 for none
+}
+
+func newFakeClient(data []byte, chunkSize int32) *fakeClient {
+	return &fakeClient{data: data, chunkSize: chunkSize, corrupt: -1}
+}
+
+func (c *fakeClient) totalChunks() int32 {
+	return int32((int64(len(c.data)) + int64(c.chunkSize) - 1) / int64(c.chunkSize))
+}
+
+func (c *fakeClient) GetFileMetadata(ctx context.Context, in *pb.FileMetadataRequest, opts ...grpc.CallOption) (*pb.FileMetadataResponse, error) {
+	resp := &pb.FileMetadataResponse{TotalSize: int64(len(c.data)), TotalChunks: c.totalChunks(), ChunkSize: c.chunkSize}
+	if in.Checksum {
+		resp.FileChecksum = util.Checksum(c.data)
+	}
+	return resp, nil
+}
+
+func (c *fakeClient) GetFileStream(ctx context.Context, in *pb.FileRequest, opts ...grpc.CallOption) (pb.FileService_GetFileStreamClient, error) {
+	c.mu.Lock()
+	c.requests = append(c.requests, in)
+	c.mu.Unlock()
+
+	stream := &fakeStream{}
+	for seq := in.StartChunk; seq < in.EndChunk && seq < c.totalChunks(); seq++ {
+		start := int64(seq) * int64(c.chunkSize)
+		end := start + int64(c.chunkSize)
+		if end > int64(len(c.data)) {
+			end = int64(len(c.data))
+		}
+		chunk := &pb.FileChunk{
+			SequenceNumber: seq,
+			ChunkData:      c.data[start:end],
+			Checksum:       util.Checksum(c.data[start:end]),
+			TotalSize:      int64(len(c.data)),
+			TotalChunks:    c.totalChunks(),
+			ChunkSize:      c.chunkSize,
+			Offset:         start,
+		}
+		if seq == c.corrupt {
+			chunk.Checksum = util.Checksum(nil)
+		}
+		stream.chunks = append(stream.chunks, chunk)
+	}
+	return stream, nil
+}
+
+func (c *fakeClient) requestCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.requests)
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+	chunks []*pb.FileChunk
+}
+
+func (s *fakeStream) Recv() (*pb.FileChunk, error) {
+	if len(s.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestRemoteFile_ReadAt(t *testing.T) {
+	data := testData(10*16 + 5)
+	client := newFakeClient(data, 16)
+	f, err := Open(context.Background(), client, "dir/data.bin", &Options{ReadAhead: -1})
+	require.NoError(t, err)
+	defer f.Close()
+
+	info, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, "data.bin", info.Name())
+	assert.Equal(t, int64(len(data)), info.Size())
+	assert.Empty(t, f.checksum, "Open should not ask the server to hash the whole file")
+	checksum, err := f.Checksum(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, util.Checksum(data), checksum)
+
+	buf := make([]byte, 40)
+	n, err := f.ReadAt(buf, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 40, n)
+	assert.Equal(t, data[10:50], buf, "Reads spanning chunks should be stitched together")
+	assert.Equal(t, 1, client.requestCount(), "Missing chunks should be fetched in one stream")
+
+	n, err = f.ReadAt(buf[:8], 20)
+	require.NoError(t, err)
+	assert.Equal(t, data[20:28], buf[:8])
+	assert.Equal(t, 1, client.requestCount(), "Cached chunks should not be fetched again")
+
+	n, err = f.ReadAt(buf, int64(len(data))-10)
+	assert.Equal(t, io.EOF, err, "Reads past the end should report io.EOF")
+	assert.Equal(t, 10, n)
+	assert.Equal(t, data[len(data)-10:], buf[:10])
+
+	_, err = f.ReadAt(buf, int64(len(data)))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRemoteFile_ReadSeeker(t *testing.T) {
+	data := testData(1000)
+	f, err := Open(context.Background(), newFakeClient(data, 64), "data.bin", &Options{CacheChunks: 2})
+	require.NoError(t, err)
+	defer f.Close()
+
+	// iotest.TestReader checks Read, ReadAt and Seek against the expected content
+	assert.NoError(t, iotest.TestReader(f, data))
+
+	pos, err := f.Seek(-100, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(900), pos)
+	tail, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data[900:], tail)
+
+	_, err = f.Seek(-1, io.SeekStart)
+	assert.Error(t, err, "Negative positions should be rejected")
+}
+
+func TestRemoteFile_ReadAhead(t *testing.T) {
+	data := testData(8 * 16)
+	client := newFakeClient(data, 16)
+	f, err := Open(context.Background(), client, "data.bin", &Options{ReadAhead: 3})
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := make([]byte, 16)
+	_, err = f.ReadAt(buf, 0)
+	require.NoError(t, err)
+
+	// The read-ahead of chunks 1-3 runs in the background, reading them must
+	// not need another request once it completed
+	for i := 1; i <= 3; i++ {
+		_, err = f.ReadAt(buf, int64(i)*16)
+		require.NoError(t, err)
+		assert.Equal(t, data[i*16:(i+1)*16], buf)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	require.Len(t, client.requests, 2, "Chunks 1-3 should come from a single read-ahead stream")
+	assert.Equal(t, int32(1), client.requests[1].StartChunk)
+	assert.Equal(t, int32(4), client.requests[1].EndChunk)
+}
+
+func TestRemoteFile_Corrupt(t *testing.T) {
+	data := testData(4 * 16)
+	client := newFakeClient(data, 16)
+	client.corrupt = 2
+	f, err := Open(context.Background(), client, "data.bin", &Options{ReadAhead: -1})
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := make([]byte, 16)
+	_, err = f.ReadAt(buf, 16)
+	assert.NoError(t, err, "Intact chunks should still be readable")
+	_, err = f.ReadAt(buf, 32)
+	assert.Error(t, err, "A chunk with a bad checksum must not be returned")
+
+	f.Close()
+	_, err = f.ReadAt(buf, 0)
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestChunkCache(t *testing.T) {
+	c := newChunkCache(2)
+	c.add(1, []byte("a"))
+	c.add(2, []byte("b"))
+	c.get(1)
+	c.add(3, []byte("c"))
+
+	assert.True(t, c.contains(1), "Recently used chunk should be kept")
+	assert.False(t, c.contains(2), "Least recently used chunk should be evicted")
+	data, ok := c.get(3)
+	assert.True(t, ok)
+	assert.True(t, bytes.Equal([]byte("c"), data))
+}
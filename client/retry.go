@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retrySet counts how often each chunk failed verification, could not be
+// written or was not sent. Failed chunks are fetched again as gaps of the
+// journal until one of them fails too often.
+type retrySet struct {
+	mu       sync.Mutex
+	attempts map[int32]int   // Failed attempts per chunk
+	lastErr  map[int32]error // Most recent failure per chunk
+}
+
+func newRetrySet() *retrySet {
+	return &retrySet{attempts: make(map[int32]int), lastErr: make(map[int32]error)}
+}
+
+// fail records a failed attempt at chunk seq
+func (r *retrySet) fail(seq int32, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts[seq]++
+	r.lastErr[seq] = err
+}
+
+// failed returns the chunks that failed at least once, in ascending order
+func (r *retrySet) failed() []int32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seqs := make([]int32, 0, len(r.attempts))
+	for seq := range r.attempts {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// exhausted returns an error for the first chunk that failed maxAttempts times
+func (r *retrySet) exhausted(maxAttempts int) error {
+	for _, seq := range r.failed() {
+		r.mu.Lock()
+		attempts, err := r.attempts[seq], r.lastErr[seq]
+		r.mu.Unlock()
+		if attempts >= maxAttempts {
+			return fmt.Errorf("chunk %d failed %d times: %w", seq, attempts, err)
+		}
+	}
+	return nil
+}
+
+// fatalCodes are the gRPC status codes retrying a request cannot fix
+var fatalCodes = map[codes.Code]bool{
+	codes.InvalidArgument:  true,
+	codes.NotFound:         true,
+	codes.PermissionDenied: true,
+	codes.Unauthenticated:  true,
+	codes.OutOfRange:       true,
+	codes.Unimplemented:    true,
+	codes.DataLoss:         true,
+}
+
+// retryable reports whether err may go away by retrying. Errors that carry
+// no gRPC status, such as a dropped connection, are retryable.
+func retryable(err error) bool {
+	if s, ok := status.FromError(err); ok {
+		return !fatalCodes[s.Code()]
+	}
+	return true
+}
+
+// retryAfter returns the pause the server asked for in a RetryInfo detail of err
+func retryAfter(err error) (time.Duration, bool) {
+	s, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// backoff returns the pause before the retry that follows failed attempt
+// number attempt, without jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// wait pauses before the retry that follows failed attempt number attempt
+// of an operation started at started. It returns an error instead if err is
+// fatal, the policy allows no further attempt or ctx ends first.
+func (p RetryPolicy) wait(ctx context.Context, attempt int, started time.Time, err error) error {
+	if !retryable(err) {
+		return err
+	}
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+	}
+
+	delay, ok := retryAfter(err)
+	if !ok {
+		delay = p.backoff(attempt)
+		if p.Jitter > 0 {
+			delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay))
+		}
+	}
+	if p.MaxElapsed > 0 && time.Since(started)+delay > p.MaxElapsed {
+		return fmt.Errorf("giving up after %s: %w", p.MaxElapsed, err)
+	}
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{Delay: time.Second, MaxDelay: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if got := policy.backoff(i + 1); got != want {
+			t.Errorf("Attempt %d: expected a pause of %s, got %s", i+1, want, got)
+		}
+	}
+	if got := (RetryPolicy{Delay: time.Second}).backoff(4); got != time.Second {
+		t.Errorf("Expected a constant pause without MaxDelay, got %s", got)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection dropped"), true},
+		{status.Error(codes.Unavailable, "unavailable"), true},
+		{status.Error(codes.ResourceExhausted, "busy"), true},
+		{status.Error(codes.Aborted, "checksum mismatch on chunk 3"), true},
+		{status.Error(codes.NotFound, "missing"), false},
+		{status.Error(codes.PermissionDenied, "denied"), false},
+		{status.Error(codes.DataLoss, "corrupt"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicy_Wait(t *testing.T) {
+	ctx := context.Background()
+	started := time.Now()
+
+	if err := (RetryPolicy{MaxAttempts: 2}).wait(ctx, 2, started, errors.New("dropped")); err == nil {
+		t.Errorf("Expected the policy to give up after its last attempt")
+	}
+	if err := (RetryPolicy{MaxElapsed: time.Minute, Delay: time.Hour}).wait(ctx, 1, started, errors.New("dropped")); err == nil {
+		t.Errorf("Expected the policy to give up once the next attempt would start too late")
+	}
+
+	// A pause asked for by the server wins over the backoff
+	s, err := status.New(codes.ResourceExhausted, "busy").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(10 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	if err := (RetryPolicy{Delay: time.Hour, MaxElapsed: time.Minute}).wait(ctx, 1, started, s.Err()); err != nil {
+		t.Fatalf("Expected a retry, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 10*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected to pause for the server's 10ms, paused %s", elapsed)
+	}
+}
+
+func TestDownloadFile_FatalStatus(t *testing.T) {
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(2), nil)
+	mockClient.On("GetFileStream", mock.Anything, mock.Anything).Return((*MockFileService_GetFileStreamClient)(nil), status.Error(codes.PermissionDenied, "denied")).Once()
+
+	// Retrying forever would hang if the error were retried
+	d := newTestDownloader(t, mockClient, WithRetryPolicy(RetryPolicy{Delay: time.Hour}))
+	err := d.Download(context.Background(), testFileID, filepath.Join(t.TempDir(), "out.bin"))
+	if status.Code(errors.Unwrap(err)) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied, got %v", err)
+	}
+	mockClient.AssertExpectations(t)
+}
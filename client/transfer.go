@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// transferFile fetches the chunk runs gaps, part of the download split
+// across streams, over the flow-controlled Transfer RPC of client. At most
+// d.window chunks are in flight: each one gives its credit back once it has
+// been handled. A written chunk is only acknowledged once a journal
+// checkpoint has made it durable, so the server keeps chunks a crash could
+// still lose. Those and the chunks that failed stay unacknowledged, and the
+// server sends them again when the next attempt reconnects to the transfer
+// the journal records for the part.
+func (d *Downloader) transferFile(ctx context.Context, client pb.FileServiceClient, t *transfer, part int, gaps [][2]int32) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.Transfer(ctx)
+	if err != nil {
+		return err
+	}
+	start := &pb.TransferStart{
+		FileId:     t.fileID,
+		ChunkSize:  t.metadata.ChunkSize,
+		Window:     int32(d.window),
+		TransferId: t.journal.transferID(part),
+		Sparse:     d.sparse,
+		Codecs:     d.codecs,
+	}
+	for _, gap := range gaps {
+		start.Ranges = append(start.Ranges, &pb.ChunkRange{StartChunk: gap[0], EndChunk: gap[1]})
+	}
+	if err := stream.Send(&pb.TransferRequest{Start: start}); err != nil {
+		return err
+	}
+
+	resp, err := stream.Recv()
+	if err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			t.journal.setTransferID(part, "") // Start a new transfer next time
+		}
+		return err
+	}
+	if resp.Session == nil {
+		return fmt.Errorf("transfer of %s did not start with a session", t.fileID)
+	}
+	if resp.Session.ChunkSize != t.metadata.ChunkSize {
+		return &permanentError{fmt.Errorf("transfer uses %d byte chunks, metadata reported %d", resp.Session.ChunkSize, t.metadata.ChunkSize)}
+	}
+	t.journal.setTransferID(part, resp.Session.TransferId)
+
+	wanted := make(map[int32]bool)
+	for _, gap := range gaps {
+		for seq := gap[0]; seq < gap[1]; seq++ {
+			wanted[seq] = true
+		}
+	}
+	control := &transferControl{stream: stream, journal: t.journal, remaining: len(wanted)}
+
+	var wg sync.WaitGroup
+	var resultErr error
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			resultErr = err
+			break
+		}
+		chunk := resp.Chunk
+		if chunk == nil {
+			continue
+		}
+		if chunk.ChunkSize != t.metadata.ChunkSize {
+			resultErr = &permanentError{fmt.Errorf("chunk %d uses %d byte chunks, metadata reported %d", chunk.SequenceNumber, chunk.ChunkSize, t.metadata.ChunkSize)}
+			break
+		}
+		if !wanted[chunk.SequenceNumber] {
+			// Resent after a reconnect although an earlier run wrote it
+			control.release(chunk.SequenceNumber, t.journal.verifiedChunk(chunk.SequenceNumber), false)
+			continue
+		}
+		delete(wanted, chunk.SequenceNumber)
+
+		wg.Add(1)
+		err = t.writes.submit(ctx, writeJob{chunk: chunk, done: func(err error) {
+			defer wg.Done()
+			if err != nil {
+				t.retries.fail(chunk.SequenceNumber, err) // Fetched again as a gap
+				control.release(chunk.SequenceNumber, false, true)
+				return
+			}
+			control.release(chunk.SequenceNumber, true, true)
+			d.reportProgress(t)
+		}})
+		if err != nil {
+			wg.Done()
+			resultErr = err
+			break
+		}
+	}
+
+	wg.Wait()
+	if resultErr == nil {
+		resultErr = control.saveErr()
+	}
+	if resultErr == nil {
+		// The stream ended cleanly without some chunks, count that against them
+		for seq := range wanted {
+			t.retries.fail(seq, fmt.Errorf("chunk %d was not sent", seq))
+		}
+	}
+	return resultErr
+}
+
+// transferControl sends credit and acknowledgements on a Transfer stream,
+// which several chunk handlers share
+type transferControl struct {
+	stream  pb.FileService_TransferClient
+	journal *journal
+
+	mu        sync.Mutex
+	written   []int32 // Chunks written but not acknowledged, as they are not durable yet
+	remaining int     // Wanted chunks not handled yet
+	closed    bool    // Whether the client side of the stream was closed
+	err       error   // Error of the checkpoint before closing
+}
+
+// release gives the credit of a handled chunk back to the server, along
+// with acknowledgements of the written chunks that have become durable since.
+// Once the last wanted chunk has been handled a checkpoint makes the written
+// chunks durable as far as the sync policy allows, and the client side of
+// the stream is closed, which ends the transfer even if some chunks failed.
+// Send errors surface on the next Recv.
+func (c *transferControl) release(seq int32, written, wanted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if written {
+		c.written = append(c.written, seq)
+	}
+	if wanted {
+		c.remaining--
+	}
+	if c.remaining == 0 {
+		if err := c.journal.save(); err != nil {
+			c.err = &permanentError{fmt.Errorf("saving resume journal: %w", err)}
+		}
+	}
+
+	req := &pb.TransferRequest{Credit: 1}
+	pending := c.written[:0]
+	for _, seq := range c.written {
+		if c.journal.durableChunk(seq) {
+			req.Acks = append(req.Acks, seq)
+		} else {
+			pending = append(pending, seq)
+		}
+	}
+	c.written = pending
+	c.stream.Send(req)
+
+	if c.remaining == 0 {
+		c.stream.CloseSend()
+		c.closed = true
+	}
+}
+
+// saveErr returns the error of the checkpoint taken before closing the stream
+func (c *transferControl) saveErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc"
+)
+
+// fakeTransferStream plays the server side of a Transfer stream: it sends
+// its chunks in order as far as the client's credit allows
+type fakeTransferStream struct {
+	grpc.ClientStream
+
+	session   *pb.TransferSession
+	chunks    []*pb.FileChunk
+	failAfter int // Fail once this many chunks were sent, 0 to never fail
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	start       *pb.TransferStart
+	credit      int32
+	inFlight    int // Chunks sent whose credit was not given back yet
+	maxInFlight int
+	acks        []int32
+	sent        int
+	sessionSent bool
+	closed      bool
+}
+
+func newFakeTransferStream(id string, failAfter int, chunks ...*pb.FileChunk) *fakeTransferStream {
+	s := &fakeTransferStream{
+		session:   &pb.TransferSession{TransferId: id, ChunkSize: defaultChunkSize},
+		chunks:    chunks,
+		failAfter: failAfter,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *fakeTransferStream) Send(req *pb.TransferRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Start != nil {
+		s.start = req.Start
+		s.credit = req.Start.Window
+	}
+	s.credit += req.Credit
+	s.inFlight -= int(req.Credit)
+	s.acks = append(s.acks, req.Acks...)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *fakeTransferStream) CloseSend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *fakeTransferStream) Recv() (*pb.TransferResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sessionSent {
+		s.sessionSent = true
+		return &pb.TransferResponse{Session: s.session}, nil
+	}
+	for !s.closed && (s.credit == 0 || s.sent == len(s.chunks)) {
+		if s.failAfter > 0 && s.sent == s.failAfter {
+			break
+		}
+		s.cond.Wait()
+	}
+	if s.failAfter > 0 && s.sent == s.failAfter {
+		return nil, errors.New("connection dropped")
+	}
+	if s.closed {
+		return nil, io.EOF
+	}
+	chunk := s.chunks[s.sent]
+	s.sent++
+	s.credit--
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	return &pb.TransferResponse{Chunk: chunk}, nil
+}
+
+func TestTransferFile_Window(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	var chunks []*pb.FileChunk
+	for i := 0; i < 6; i++ {
+		chunks = append(chunks, zeroChunk(i))
+	}
+	stream := newFakeTransferStream("t1", 0, chunks...)
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(6), nil)
+	mockClient.On("Transfer", mock.Anything).Return(stream, nil).Once()
+
+	if err := newTestDownloader(t, mockClient, WithTransferWindow(2)).Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	if stream.maxInFlight > 2 {
+		t.Errorf("Expected at most 2 chunks in flight, got %d", stream.maxInFlight)
+	}
+	sort.Slice(stream.acks, func(i, j int) bool { return stream.acks[i] < stream.acks[j] })
+	if len(stream.acks) != 6 || stream.acks[5] != 5 {
+		t.Errorf("Expected every chunk to be acknowledged, got %v", stream.acks)
+	}
+	if !stream.closed {
+		t.Errorf("Expected the client to close the stream once every chunk was written")
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestTransferFile_ReconnectsAfterDrop(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	// The connection drops after two of four chunks
+	first := newFakeTransferStream("t1", 2, zeroChunk(0), zeroChunk(1), zeroChunk(2), zeroChunk(3))
+	second := newFakeTransferStream("t1", 0, zeroChunk(2), zeroChunk(3))
+	second.session.Resumed = true
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(4), nil)
+	mockClient.On("Transfer", mock.Anything).Return(first, nil).Once()
+	mockClient.On("Transfer", mock.Anything).Return(second, nil).Once()
+
+	d := newTestDownloader(t, mockClient, WithTransferWindow(4), WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	if err := d.Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	if first.start.TransferId != "" {
+		t.Errorf("Expected the first attempt to start a new transfer, got %q", first.start.TransferId)
+	}
+	if second.start.TransferId != "t1" {
+		t.Errorf("Expected the retry to reconnect to transfer t1, got %q", second.start.TransferId)
+	}
+	if len(second.start.Ranges) != 1 || second.start.Ranges[0].StartChunk != 2 || second.start.Ranges[0].EndChunk != 4 {
+		t.Errorf("Expected the retry to ask for chunks [2, 4), got %v", second.start.Ranges)
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestTransferFile_AcksDurableChunks(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.bin")
+
+	stream := newFakeTransferStream("t1", 0, zeroChunk(0), zeroChunk(1), zeroChunk(2))
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("GetFileMetadata", mock.Anything, mock.Anything).Return(testMetadata(3), nil)
+	mockClient.On("Transfer", mock.Anything).Return(stream, nil).Once()
+
+	// Written chunks are only flushed with the finished file, after the transfer
+	d := newTestDownloader(t, mockClient, WithTransferWindow(2), WithSyncPolicy(SyncPolicy{Mode: SyncOnComplete}))
+	if err := d.Download(context.Background(), testFileID, dst); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	if len(stream.acks) != 0 {
+		t.Errorf("Expected chunks that are not durable to stay unacknowledged, got %v", stream.acks)
+	}
+	if !stream.closed || stream.credit != 2 {
+		t.Errorf("Expected every credit to be given back and the stream closed, got %d credit", stream.credit)
+	}
+	mockClient.AssertExpectations(t)
+}
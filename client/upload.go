@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/4erneff/alcatraz/client/util"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+)
+
+// Upload uploads a local file under fileID. The server keeps every chunk it
+// verified, so after a failure the upload resumes, according to the retry
+// policy, with the chunks that GetUploadStatus does not report as received.
+// The whole-file checksum sent along ties the session to this content, so a
+// different file of the same size never resumes it. A file that shrinks
+// while it is uploaded fails the upload.
+func Upload(ctx context.Context, client pb.FileServiceClient, fileID string, path string, retry RetryPolicy) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, fileInfo.Size())); err != nil {
+		return err
+	}
+
+	status, err := client.StartUpload(ctx, &pb.StartUploadRequest{
+		FileId:    fileID,
+		TotalSize: fileInfo.Size(),
+		Checksum:  fmt.Sprintf("%x", hash.Sum(nil)),
+	})
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	for attempt := 1; !status.Complete; attempt++ {
+		status, err = sendMissingChunks(ctx, client, file, status)
+		if err == nil {
+			continue
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return fmt.Errorf("uploading %s: %w", fileID, permanent.err)
+		}
+		if err := retry.wait(ctx, attempt, started, err); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("uploading %s: %w", fileID, err)
+		}
+		if status, err = client.GetUploadStatus(ctx, &pb.UploadStatusRequest{UploadId: status.UploadId}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendMissingChunks streams every chunk the status does not list as received.
+// On failure it returns the status it was given together with the error.
+func sendMissingChunks(ctx context.Context, client pb.FileServiceClient, file io.ReaderAt, status *pb.UploadStatus) (*pb.UploadStatus, error) {
+	received := make(map[int32]bool, len(status.ReceivedChunks))
+	for _, seq := range status.ReceivedChunks {
+		received[seq] = true
+	}
+
+	stream, err := client.UploadFile(ctx)
+	if err != nil {
+		return status, err
+	}
+
+	buffer := make([]byte, status.ChunkSize)
+	for seq := int32(0); seq < status.TotalChunks; seq++ {
+		if received[seq] {
+			continue
+		}
+
+		offset := int64(seq) * int64(status.ChunkSize)
+		size := status.TotalSize - offset
+		if size > int64(status.ChunkSize) {
+			size = int64(status.ChunkSize)
+		}
+		n, err := file.ReadAt(buffer[:size], offset)
+		if int64(n) == size {
+			err = nil // io.EOF after the last byte
+		} else if err == nil || err == io.EOF {
+			// The file shrank since the upload started, retrying cannot help
+			return status, &permanentError{fmt.Errorf("chunk %d: read %d of %d bytes at offset %d, the file shrank", seq, n, size, offset)}
+		}
+		if err != nil {
+			return status, err
+		}
+
+		chunk := &pb.UploadChunk{
+			UploadId:       status.UploadId,
+			SequenceNumber: seq,
+			ChunkData:      buffer[:size],
+			Checksum:       util.Checksum(buffer[:size]),
+		}
+		if err := stream.Send(chunk); err != nil {
+			// The real cause is reported by CloseAndRecv
+			break
+		}
+	}
+
+	final, err := stream.CloseAndRecv()
+	if err != nil {
+		return status, err
+	}
+	return final, nil
+}
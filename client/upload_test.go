@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/4erneff/alcatraz/client/util"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc"
+)
+
+type MockFileService_UploadFileClient struct {
+	grpc.ClientStream
+	mock.Mock
+	sent []*pb.UploadChunk
+}
+
+func (m *MockFileService_UploadFileClient) Send(chunk *pb.UploadChunk) error {
+	chunk.ChunkData = append([]byte(nil), chunk.ChunkData...) // The client reuses its buffer
+	m.sent = append(m.sent, chunk)
+	args := m.Called(chunk.SequenceNumber)
+	return args.Error(0)
+}
+
+func (m *MockFileService_UploadFileClient) CloseAndRecv() (*pb.UploadStatus, error) {
+	args := m.Called()
+	return args.Get(0).(*pb.UploadStatus), args.Error(1)
+}
+
+func TestUploadFile_Resume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5) // 50 bytes in chunks of 16
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to create upload source: %v", err)
+	}
+
+	status := &pb.UploadStatus{UploadId: "u1", FileId: testFileID, TotalSize: 50, TotalChunks: 4, ChunkSize: 16, ReceivedChunks: []int32{1}}
+	mockClient := new(MockFileServiceClient)
+	start := &pb.StartUploadRequest{FileId: testFileID, TotalSize: 50, Checksum: util.Checksum(data)}
+	mockClient.On("StartUpload", mock.Anything, start).Return(status, nil).Once()
+
+	// The first stream fails after chunk 0, the server reports chunks 0 and 1 afterwards
+	failing := new(MockFileService_UploadFileClient)
+	failing.On("Send", int32(0)).Return(nil)
+	failing.On("Send", int32(2)).Return(errors.New("EOF"))
+	failing.On("CloseAndRecv").Return((*pb.UploadStatus)(nil), errors.New("connection dropped"))
+	mockClient.On("UploadFile", mock.Anything).Return(failing, nil).Once()
+
+	resumed := &pb.UploadStatus{UploadId: "u1", FileId: testFileID, TotalSize: 50, TotalChunks: 4, ChunkSize: 16, ReceivedChunks: []int32{0, 1}}
+	mockClient.On("GetUploadStatus", mock.Anything, &pb.UploadStatusRequest{UploadId: "u1"}).Return(resumed, nil).Once()
+
+	succeeding := new(MockFileService_UploadFileClient)
+	succeeding.On("Send", mock.Anything).Return(nil)
+	succeeding.On("CloseAndRecv").Return(&pb.UploadStatus{UploadId: "u1", Complete: true}, nil)
+	mockClient.On("UploadFile", mock.Anything).Return(succeeding, nil).Once()
+
+	if err := Upload(context.Background(), mockClient, testFileID, path, RetryPolicy{MaxAttempts: 2}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	if len(succeeding.sent) != 2 || succeeding.sent[0].SequenceNumber != 2 || succeeding.sent[1].SequenceNumber != 3 {
+		t.Fatalf("Expected only chunks 2 and 3 to be resent, got %v", succeeding.sent)
+	}
+	last := succeeding.sent[1]
+	if !bytes.Equal(last.ChunkData, data[48:]) || !util.VerifyChecksum(last.ChunkData, last.Checksum) {
+		t.Errorf("Last chunk should carry the file tail with a valid checksum")
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestUploadFile_SourceShrank(t *testing.T) {
+	// The server expects 50 bytes, but only 40 are left in the file
+	status := &pb.UploadStatus{UploadId: "u1", FileId: testFileID, TotalSize: 50, TotalChunks: 4, ChunkSize: 16}
+	stream := new(MockFileService_UploadFileClient)
+	stream.On("Send", mock.Anything).Return(nil)
+	mockClient := new(MockFileServiceClient)
+	mockClient.On("UploadFile", mock.Anything).Return(stream, nil).Once()
+
+	_, err := sendMissingChunks(context.Background(), mockClient, bytes.NewReader(make([]byte, 40)), status)
+	var permanent *permanentError
+	if !errors.As(err, &permanent) {
+		t.Fatalf("Expected a short read to fail the upload for good, got %v", err)
+	}
+	if len(stream.sent) != 2 {
+		t.Fatalf("Expected only the two complete chunks to be sent, got %d", len(stream.sent))
+	}
+}
@@ -9,13 +9,19 @@ const (
 	serverAddr = "localhost:50051"
 )
 
+// GetConn connects to the default server address using server.crt from the working directory
 func GetConn() (*grpc.ClientConn, error) {
-	creds, err := credentials.NewClientTLSFromFile("server.crt", "")
+	return Dial(serverAddr, "server.crt")
+}
+
+// Dial connects to addr over TLS, trusting the certificate in certFile
+func Dial(addr string, certFile string) (*grpc.ClientConn, error) {
+	creds, err := credentials.NewClientTLSFromFile(certFile, "")
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := grpc.Dial(serverAddr, grpc.WithTransportCredentials(creds))
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package util
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to an unprivileged user
+// on the filesystem holding dir
+func FreeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// Preallocate sets the length of file to size and reserves its blocks with
+// fallocate, so the disk cannot run full halfway through writing it. On
+// filesystems without fallocate the file is only resized.
+func Preallocate(file *os.File, size int64) error {
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return Reserve(file, 0, size)
+}
+
+// Reserve allocates the blocks of length bytes of file at offset with
+// fallocate, without changing the file's length beyond offset+length. On
+// filesystems without fallocate it does nothing.
+func Reserve(file *os.File, offset, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), 0, offset, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
+
+// Fallocate modes that deallocate a range while keeping the file size
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// ZeroRange makes length bytes of file at offset read as zeros. It punches a
+// hole, so the range takes no space on disk, and falls back to writing zeros
+// on filesystems that cannot.
+func ZeroRange(file *os.File, offset, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return writeZeros(file, offset, length)
+	}
+	return err
+}
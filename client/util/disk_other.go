@@ -0,0 +1,27 @@
+//go:build !linux
+
+package util
+
+import "os"
+
+// FreeSpace returns the number of bytes available on the filesystem holding
+// dir. It is only implemented on Linux.
+func FreeSpace(dir string) (uint64, error) {
+	return 0, ErrFreeSpaceUnknown
+}
+
+// Preallocate sets the length of file to size
+func Preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
+
+// Reserve does nothing; reserving blocks is only implemented on Linux
+func Reserve(file *os.File, offset, length int64) error {
+	return nil
+}
+
+// ZeroRange makes length bytes of file at offset read as zeros by writing
+// them. Punching holes is only implemented on Linux.
+func ZeroRange(file *os.File, offset, length int64) error {
+	return writeZeros(file, offset, length)
+}
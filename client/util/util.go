@@ -2,15 +2,24 @@ package util
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 )
 
+// ErrFreeSpaceUnknown is returned by FreeSpace on platforms it cannot query
+var ErrFreeSpaceUnknown = errors.New("free disk space cannot be determined on this platform")
+
+// Checksum returns the hex encoded SHA-256 of data, as carried by file and upload chunks
+func Checksum(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
 // verifyChecksum verifies if the checksum matches the received data
 func VerifyChecksum(data []byte, expectedChecksum string) bool {
-	checksum := sha256.Sum256(data)
-	return fmt.Sprintf("%x", checksum) == expectedChecksum
+	return Checksum(data) == expectedChecksum
 }
 
 func CreateFileDescriptors(filePath string, num int) ([]*os.File, []sync.Mutex, error) {
@@ -25,3 +34,48 @@ func CreateFileDescriptors(filePath string, num int) ([]*os.File, []sync.Mutex,
 	}
 	return files, mutexes, nil
 }
+
+// VerifyFile checks that the file at path has the expected size and whole-file
+// SHA-256 checksum; an empty checksum only checks the size. The returned
+// error describes the exact mismatch.
+func VerifyFile(path string, expectedSize int64, expectedChecksum string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() != expectedSize {
+		return fmt.Errorf("size mismatch: %s has %d bytes, expected %d", path, fileInfo.Size(), expectedSize)
+	}
+	if expectedChecksum == "" {
+		return nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if checksum := fmt.Sprintf("%x", hash.Sum(nil)); checksum != expectedChecksum {
+		return fmt.Errorf("checksum mismatch: %s has SHA-256 %s, expected %s", path, checksum, expectedChecksum)
+	}
+	return nil
+}
+
+// writeZeros writes length zero bytes to file at offset
+func writeZeros(file *os.File, offset, length int64) error {
+	zeros := make([]byte, min(length, 1024*1024))
+	for length > 0 {
+		n := min(length, int64(len(zeros)))
+		if _, err := file.WriteAt(zeros[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -28,6 +29,14 @@ func TestVerifyChecksum(t *testing.T) {
 	}
 }
 
+// TestChecksum tests the Checksum function.
+func TestChecksum(t *testing.T) {
+	data := []byte("Hello, World!")
+	if got, want := Checksum(data), fmt.Sprintf("%x", sha256.Sum256(data)); got != want {
+		t.Errorf("Expected checksum %s, got %s", want, got)
+	}
+}
+
 // TestCreateFileDescriptors tests the CreateFileDescriptors function.
 func TestCreateFileDescriptors(t *testing.T) {
 	// Create a temporary file to test file descriptor creation.
@@ -65,3 +74,99 @@ func TestCreateFileDescriptors(t *testing.T) {
 		t.Error("Expected an error for invalid file path, got nil")
 	}
 }
+
+// TestVerifyFile tests the VerifyFile function.
+func TestVerifyFile(t *testing.T) {
+	data := []byte("Hello, World!")
+	path := t.TempDir() + "/file.bin"
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	// Test case 1: Matching file
+	if err := VerifyFile(path, int64(len(data)), checksum); err != nil {
+		t.Errorf("Expected file to verify, got %v", err)
+	}
+
+	// Test case 2: Wrong size, e.g. a missing last chunk
+	if err := VerifyFile(path, int64(len(data))+1, checksum); err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Errorf("Expected size mismatch, got %v", err)
+	}
+
+	// Test case 3: Same size, different content
+	if err := VerifyFile(path, int64(len(data)), Checksum([]byte("other"))); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+
+	// Test case 4: Missing file
+	if err := VerifyFile(path+".missing", 0, checksum); err == nil {
+		t.Error("Expected an error for a missing file, got nil")
+	}
+
+	// Test case 5: No checksum known, only the size is checked
+	if err := VerifyFile(path, int64(len(data)), ""); err != nil {
+		t.Errorf("Expected the size alone to verify, got %v", err)
+	}
+	if err := VerifyFile(path, int64(len(data))+1, ""); err == nil {
+		t.Error("Expected a size mismatch without a checksum, got nil")
+	}
+}
+
+// TestPreallocate tests the Preallocate function.
+func TestPreallocate(t *testing.T) {
+	path := t.TempDir() + "/file.bin"
+	if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	// Test case 1: Growing the file
+	if err := Preallocate(file, 4096); err != nil {
+		t.Fatalf("Failed to preallocate: %v", err)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != 4096 {
+		t.Errorf("Expected a 4096 byte file, got %v, %v", info, err)
+	}
+
+	// Test case 2: Cutting a longer file
+	if err := Preallocate(file, 10); err != nil {
+		t.Fatalf("Failed to preallocate: %v", err)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != 10 {
+		t.Errorf("Expected a 10 byte file, got %v, %v", info, err)
+	}
+}
+
+func TestZeroRange(t *testing.T) {
+	path := t.TempDir() + "/file.bin"
+	data := make([]byte, 3*4096)
+	for i := range data {
+		data[i] = 0xff
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	if err := ZeroRange(file, 4096, 4096+10); err != nil {
+		t.Fatalf("Failed to zero range: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || len(got) != len(data) {
+		t.Fatalf("Expected the size to be kept, got %d bytes, %v", len(got), err)
+	}
+	for i, b := range got {
+		if zeroed := i >= 4096 && i < 2*4096+10; zeroed != (b == 0) {
+			t.Fatalf("Byte %d is %#x, zeroed: %v", i, b, zeroed)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package codec compresses the data of file chunks on the wire.
+//
+// The client advertises the codecs it can decode, most preferred first, and
+// the server tags every chunk with the codec it actually used. A chunk that
+// does not shrink is sent raw, so compressing incompressible files only costs
+// the attempt. Checksums are always computed over the uncompressed bytes.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	None = ""     // Raw data
+	Gzip = "gzip" // RFC 1952 gzip
+	Zstd = "zstd" // Zstandard, faster and usually smaller than gzip
+)
+
+// Supported lists the codecs this build can encode and decode, most preferred first
+var Supported = []string{Zstd, Gzip}
+
+// ErrUnknown is returned for codecs this build does not implement
+var ErrUnknown = errors.New("unknown codec")
+
+// ErrTooLarge is returned when data decompresses to more bytes than allowed
+var ErrTooLarge = errors.New("decompressed data exceeds the expected size")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+)
+
+// zstdCoders returns the shared zstd encoder and decoder, which are safe for
+// concurrent use
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// Known reports whether name is a codec this build implements
+func Known(name string) bool {
+	for _, codec := range Supported {
+		if name == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the first of the offered codecs that is also available,
+// or None if they have none in common
+func Negotiate(offered, available []string) string {
+	for _, codec := range offered {
+		for _, candidate := range available {
+			if codec == candidate && Known(codec) {
+				return codec
+			}
+		}
+	}
+	return None
+}
+
+// Compress returns data compressed with the named codec
+func Compress(name string, data []byte) ([]byte, error) {
+	switch name {
+	case None:
+		return data, nil
+	case Zstd:
+		encoder, _, err := zstdCoders()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, make([]byte, 0, len(data))), nil
+	case Gzip:
+		var buffer bytes.Buffer
+		buffer.Grow(len(data))
+		writer := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(writer)
+		writer.Reset(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknown, name)
+}
+
+// Decompress returns data decompressed with the named codec. Data that
+// decompresses to more than limit bytes is rejected with ErrTooLarge.
+func Decompress(name string, data []byte, limit int) ([]byte, error) {
+	switch name {
+	case None:
+		if len(data) > limit {
+			return nil, ErrTooLarge
+		}
+		return data, nil
+	case Zstd:
+		_, decoder, err := zstdCoders()
+		if err != nil {
+			return nil, err
+		}
+		out, err := decoder.DecodeAll(data, make([]byte, 0, limit))
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, ErrTooLarge
+		}
+		return out, err
+	case Gzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		out, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, ErrTooLarge
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknown, name)
+}
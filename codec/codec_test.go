@@ -0,0 +1,54 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("2024-05-01T12:00:00Z INFO chunk written\n"), 1000)
+	random := make([]byte, 4096)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, name := range append([]string{None}, Supported...) {
+		compressed, err := Compress(name, text)
+		require.NoError(t, err, name)
+		if name != None {
+			assert.Less(t, len(compressed)*10, len(text), "%s should shrink repetitive text tenfold", name)
+		}
+		out, err := Decompress(name, compressed, len(text))
+		require.NoError(t, err, name)
+		assert.Equal(t, text, out, name)
+
+		compressed, err = Compress(name, random)
+		require.NoError(t, err, name)
+		out, err = Decompress(name, compressed, len(random))
+		require.NoError(t, err, name)
+		assert.Equal(t, random, out, name)
+
+		_, err = Decompress(name, compressed, len(random)-1)
+		assert.True(t, errors.Is(err, ErrTooLarge), "%s should enforce the limit, got %v", name, err)
+	}
+
+	_, err = Compress("lz4", text)
+	assert.True(t, errors.Is(err, ErrUnknown))
+	_, err = Decompress("lz4", text, len(text))
+	assert.True(t, errors.Is(err, ErrUnknown))
+	_, err = Decompress(Gzip, []byte("not gzip"), 100)
+	assert.Error(t, err, "Corrupt data should be rejected")
+}
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, Zstd, Negotiate([]string{Zstd, Gzip}, Supported))
+	assert.Equal(t, Gzip, Negotiate([]string{"lz4", Gzip, Zstd}, Supported), "The client's preference should win")
+	assert.Equal(t, Gzip, Negotiate([]string{Zstd, Gzip}, []string{Gzip}))
+	assert.Equal(t, None, Negotiate([]string{"lz4"}, Supported))
+	assert.Equal(t, None, Negotiate(nil, Supported))
+	assert.Equal(t, None, Negotiate([]string{"lz4"}, []string{"lz4"}), "Codecs this build lacks cannot be used")
+}
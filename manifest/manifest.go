@@ -0,0 +1,161 @@
+// Package manifest builds and verifies Merkle-tree manifests of served files.
+//
+// The tree follows RFC 6962: every chunk is a leaf hashed as
+// SHA-256(0x00 || chunk), interior nodes are SHA-256(0x01 || left || right)
+// and a level with n > 1 nodes is split at the largest power of two below n.
+// A client that trusts the root hash, either because it was pinned up front
+// or because the server signed it, can check every chunk it receives
+// against the leaf hashes of a manifest whose root it has verified.
+package manifest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+)
+
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// LeafHash returns the Merkle leaf hash of a chunk
+func LeafHash(chunk []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{leafPrefix})
+	hash.Write(chunk)
+	return hash.Sum(nil)
+}
+
+// RootHash returns the Merkle tree root over the given leaf hashes
+func RootHash(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	hash := sha256.New()
+	hash.Write([]byte{nodePrefix})
+	hash.Write(RootHash(leaves[:split]))
+	hash.Write(RootHash(leaves[split:]))
+	return hash.Sum(nil)
+}
+
+// Statement returns the bytes a server signs to vouch for a manifest. It
+// binds the root hash to the file it describes and to how it was chunked.
+func Statement(m *pb.Manifest) []byte {
+	return []byte(fmt.Sprintf("alcatraz-manifest-v1\n%s\n%d\n%d\n%x\n", m.FileId, m.TotalSize, m.ChunkSize, m.RootHash))
+}
+
+// Sign fills in the signature of a manifest
+func Sign(m *pb.Manifest, key ed25519.PrivateKey) {
+	m.Signature = ed25519.Sign(key, Statement(m))
+}
+
+// Verify checks that the leaf hashes of m add up to its root hash and that
+// the root is trusted: it must equal pinnedRoot when one is given and carry a
+// valid signature by publicKey when one is given. At least one of the two
+// must be provided.
+func Verify(m *pb.Manifest, pinnedRoot []byte, publicKey ed25519.PublicKey) error {
+	if pinnedRoot == nil && publicKey == nil {
+		return errors.New("manifest: no pinned root or public key to verify against")
+	}
+	if int(m.TotalChunks) != len(m.LeafHashes) {
+		return fmt.Errorf("manifest: %d leaf hashes for %d chunks", len(m.LeafHashes), m.TotalChunks)
+	}
+	if root := RootHash(m.LeafHashes); !bytes.Equal(root, m.RootHash) {
+		return fmt.Errorf("manifest: leaf hashes add up to root %x, manifest claims %x", root, m.RootHash)
+	}
+	if pinnedRoot != nil && !bytes.Equal(pinnedRoot, m.RootHash) {
+		return fmt.Errorf("manifest: root %x does not match pinned root %x", m.RootHash, pinnedRoot)
+	}
+	if publicKey != nil && !ed25519.Verify(publicKey, Statement(m), m.Signature) {
+		return errors.New("manifest: invalid signature")
+	}
+	return nil
+}
+
+// VerifyChunk checks a chunk against the leaf hash of a verified manifest
+func VerifyChunk(m *pb.Manifest, sequenceNumber int32, chunk []byte) error {
+	if sequenceNumber < 0 || int(sequenceNumber) >= len(m.LeafHashes) {
+		return fmt.Errorf("manifest: chunk %d outside of the manifest", sequenceNumber)
+	}
+	if !bytes.Equal(LeafHash(chunk), m.LeafHashes[sequenceNumber]) {
+		return fmt.Errorf("manifest: chunk %d does not match its leaf hash", sequenceNumber)
+	}
+	return nil
+}
+
+// ParseRoot decodes a hex encoded root hash as given on a command line
+func ParseRoot(s string) ([]byte, error) {
+	root, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: invalid root hash: %w", err)
+	}
+	if len(root) != sha256.Size {
+		return nil, fmt.Errorf("manifest: root hash must be %d bytes, got %d", sha256.Size, len(root))
+	}
+	return root, nil
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("manifest: %s does not hold an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// LoadPublicKey reads a PEM encoded PKIX Ed25519 public key, as written by
+// `openssl pkey -pubout`
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("manifest: %s does not hold an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("manifest: %s does not contain a %s PEM block", path, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,105 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRootHash checks the tree against the RFC 6962 reference vectors used by
+// Certificate Transparency implementations.
+func TestRootHash(t *testing.T) {
+	inputs := []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+	var leaves [][]byte
+	for _, in := range inputs {
+		data, _ := hex.DecodeString(in)
+		leaves = append(leaves, LeafHash(data))
+	}
+
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", hex.EncodeToString(RootHash(nil)))
+	assert.Equal(t, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d", hex.EncodeToString(RootHash(leaves[:1])))
+	assert.Equal(t, "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328", hex.EncodeToString(RootHash(leaves)))
+}
+
+func testManifest(chunks ...string) *pb.Manifest {
+	m := &pb.Manifest{FileId: "a.bin", ChunkSize: 4, TotalChunks: int32(len(chunks))}
+	for _, chunk := range chunks {
+		m.TotalSize += int64(len(chunk))
+		m.LeafHashes = append(m.LeafHashes, LeafHash([]byte(chunk)))
+	}
+	m.RootHash = RootHash(m.LeafHashes)
+	return m
+}
+
+func TestVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	m := testManifest("abcd", "efgh", "ij")
+	Sign(m, privateKey)
+
+	assert.NoError(t, Verify(m, m.RootHash, nil), "Pinned root should verify")
+	assert.NoError(t, Verify(m, nil, publicKey), "Signature should verify")
+	assert.Error(t, Verify(m, nil, nil), "A manifest without trust anchor must not verify")
+	assert.Error(t, Verify(m, LeafHash([]byte("other")), nil), "A different pinned root must not verify")
+
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	assert.Error(t, Verify(m, nil, otherKey), "A signature by another key must not verify")
+
+	renamed := testManifest("abcd", "efgh", "ij")
+	renamed.Signature = m.Signature
+	renamed.FileId = "b.bin"
+	assert.Error(t, Verify(renamed, nil, publicKey), "The signature must cover the file id")
+
+	tampered := testManifest("abcd", "efgh", "ij")
+	tampered.LeafHashes[1] = LeafHash([]byte("evil"))
+	assert.Error(t, Verify(tampered, m.RootHash, nil), "Swapped leaves must not add up to the pinned root")
+
+	assert.NoError(t, VerifyChunk(m, 1, []byte("efgh")))
+	assert.Error(t, VerifyChunk(m, 1, []byte("efgX")), "Tampered chunk should be rejected")
+	assert.Error(t, VerifyChunk(m, 3, []byte("ij")), "Chunk outside the manifest should be rejected")
+}
+
+func TestLoadKeys(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	der, err = x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pub.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	loadedPrivate, err := LoadPrivateKey(filepath.Join(dir, "key.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, privateKey, loadedPrivate)
+	loadedPublic, err := LoadPublicKey(filepath.Join(dir, "pub.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, publicKey, loadedPublic)
+
+	_, err = LoadPublicKey(filepath.Join(dir, "key.pem"))
+	assert.Error(t, err, "A private key is not a public key")
+}
+
+func TestParseRoot(t *testing.T) {
+	root := RootHash(nil)
+	parsed, err := ParseRoot(hex.EncodeToString(root))
+	require.NoError(t, err)
+	assert.Equal(t, root, parsed)
+
+	_, err = ParseRoot("abcd")
+	assert.Error(t, err, "Short roots should be rejected")
+	_, err = ParseRoot("zz")
+	assert.Error(t, err, "Non-hex roots should be rejected")
+}
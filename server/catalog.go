@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storeError translates a storage backend error into a gRPC status error
+func storeError(fileID string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrInvalid):
+		return status.Errorf(codes.InvalidArgument, "invalid file id %q", fileID)
+	case errors.Is(err, fs.ErrNotExist):
+		return status.Errorf(codes.NotFound, "file %q not found", fileID)
+	}
+	return err
+}
+
+// ListFiles returns every file held by the server's store
+func (s *server) ListFiles(ctx context.Context, req *pb.ListFilesRequest) (*pb.ListFilesResponse, error) {
+	files, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListFilesResponse{}
+	for _, file := range files {
+		resp.Files = append(resp.Files, &pb.FileInfo{
+			FileId:      file.Name,
+			TotalSize:   file.Size,
+			TotalChunks: chunkCount(file.Size, s.chunkLimits().Default),
+		})
+	}
+	return resp, nil
+}
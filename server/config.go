@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/4erneff/alcatraz/codec"
+	"github.com/4erneff/alcatraz/synthetic"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper-cased flag name, with dashes turned
+// into underscores, to form the environment variable overriding it
+const envPrefix = "ALCATRAZ_"
+
+// config is the configuration of the server. It is assembled from the
+// defaults, a YAML or JSON file, ALCATRAZ_* environment variables and
+// command line flags, each overriding the previous ones.
+type config struct {
+	Listen      string           `yaml:"listen"`       // Address the gRPC server listens on
+	Store       string           `yaml:"store"`        // Storage backend: local or s3
+	Root        string           `yaml:"root"`         // Directory served by the local store
+	S3          s3Settings       `yaml:"s3"`           // Bucket served by the s3 store
+	TLS         tlsSettings      `yaml:"tls"`          // Certificate the server presents
+	Chunks      chunkLimits      `yaml:"chunks"`       // Chunk sizes clients may negotiate
+	Codecs      []string         `yaml:"codecs"`       // Codecs chunks may be compressed with, empty to always send them raw
+	Generate    generateSettings `yaml:"generate"`     // Synthetic test file served next to the stored ones
+	Synthetic   bool             `yaml:"synthetic"`    // Serve synthetic/<size>?seed=<n> files computed on the fly
+	ManifestKey string           `yaml:"manifest_key"` // PEM encoded Ed25519 key manifests are signed with, empty to leave them unsigned
+	UploadDir   string           `yaml:"upload_dir"`   // Directory partial uploads are staged in
+}
+
+type s3Settings struct {
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	Prefix   string `yaml:"prefix"`
+}
+
+type tlsSettings struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// generateSettings describes the synthetic test file the server generates.
+// Generation is off unless a file is named.
+type generateSettings struct {
+	File      string            `yaml:"file"`      // Name of the file, empty to generate nothing
+	Size      int64             `yaml:"size"`      // Size in bytes
+	Pattern   synthetic.Pattern `yaml:"pattern"`   // Content of the file: zeros, random, repeat or text
+	Seed      int64             `yaml:"seed"`      // Seed of the random, repeat and text patterns
+	Virtual   bool              `yaml:"virtual"`   // Serve the content without writing it to disk
+	Overwrite bool              `yaml:"overwrite"` // Regenerate the file on disk even if it exists
+}
+
+// defaultConfig returns the configuration used for everything that is not set
+func defaultConfig() config {
+	return config{
+		Listen:    ":50051",
+		Store:     "local",
+		Root:      ".",
+		S3:        s3Settings{Region: "us-east-1"},
+		TLS:       tlsSettings{Cert: "server.crt", Key: "server.key"},
+		Chunks:    defaultChunkLimits,
+		Codecs:    append([]string(nil), codec.Supported...),
+		Generate:  generateSettings{Size: 1024 * 1024 * 1024, Pattern: synthetic.PatternZeros},
+		UploadDir: filepath.Join(os.TempDir(), "alcatraz-uploads"),
+	}
+}
+
+// bindFlags registers a flag for every setting of c
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address the server listens on")
+	fs.StringVar(&c.Store, "store", c.Store, "storage backend to serve files from: local or s3")
+	fs.StringVar(&c.Root, "root", c.Root, "directory whose files are served by the local store")
+	fs.StringVar(&c.S3.Endpoint, "s3-endpoint", c.S3.Endpoint, "base URL of the S3-compatible service")
+	fs.StringVar(&c.S3.Region, "s3-region", c.S3.Region, "region used to sign S3 requests")
+	fs.StringVar(&c.S3.Bucket, "s3-bucket", c.S3.Bucket, "bucket holding the served files")
+	fs.StringVar(&c.S3.Prefix, "s3-prefix", c.S3.Prefix, "key prefix the served files live under")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "PEM encoded certificate the server presents")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "PEM encoded private key of the certificate")
+	fs.Var((*int32Value)(&c.Chunks.Default), "chunk-size", "chunk size in bytes used when a client has no preference")
+	fs.Var((*int32Value)(&c.Chunks.Min), "min-chunk-size", "smallest chunk size in bytes a client may ask for")
+	fs.Var((*int32Value)(&c.Chunks.Max), "max-chunk-size", "largest chunk size in bytes a client may ask for")
+	fs.Var((*listValue)(&c.Codecs), "codecs", "comma-separated compression codecs chunks may be sent with (zstd, gzip), empty to never compress")
+	fs.StringVar(&c.Generate.File, "generate-file", c.Generate.File, "name of a synthetic test file to generate, empty to generate none")
+	fs.Int64Var(&c.Generate.Size, "generate-size", c.Generate.Size, "size in bytes of the generated file")
+	fs.StringVar((*string)(&c.Generate.Pattern), "generate-pattern", string(c.Generate.Pattern), "content of the generated file: zeros, random, repeat or text")
+	fs.Int64Var(&c.Generate.Seed, "generate-seed", c.Generate.Seed, "seed of the generated content, the same seed gives the same file")
+	fs.BoolVar(&c.Generate.Virtual, "generate-virtual", c.Generate.Virtual, "serve the generated file without writing it to disk")
+	fs.BoolVar(&c.Generate.Overwrite, "generate-overwrite", c.Generate.Overwrite, "regenerate the file on disk even if it already exists")
+	fs.BoolVar(&c.Synthetic, "synthetic", c.Synthetic, "serve deterministic files such as synthetic/10GiB?seed=42 without touching disk")
+	fs.StringVar(&c.ManifestKey, "manifest-key", c.ManifestKey, "PEM encoded Ed25519 private key used to sign manifests")
+	fs.StringVar(&c.UploadDir, "upload-dir", c.UploadDir, "directory partially uploaded files are staged in")
+}
+
+// int32Value is a flag.Value for an int32 setting
+type int32Value int32
+
+func (v *int32Value) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *int32Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return err
+	}
+	*v = int32Value(n)
+	return nil
+}
+
+// listValue is a flag.Value for a comma-separated list setting
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+// loadConfig assembles the configuration from args, the file named by
+// -config or ALCATRAZ_CONFIG, and the environment, and validates it
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	defaultPath, _ := lookupEnv(envPrefix + "CONFIG")
+	configPath := fs.String("config", defaultPath, "YAML or JSON file to read the configuration from")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	// Flags win over the file and the environment, so remember them and
+	// apply them again once those have been read
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	cfg = defaultConfig()
+	if *configPath != "" {
+		if err := cfg.readFile(*configPath); err != nil {
+			return config{}, err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		value, set := explicit[f.Name]
+		source := "flag -" + f.Name
+		if !set {
+			env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+			if value, set = lookupEnv(env); !set {
+				return
+			}
+			source = env
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", source, setErr)
+		}
+	})
+	if err != nil {
+		return config{}, err
+	}
+	return cfg, cfg.validate()
+}
+
+// readFile overrides c with the settings of a YAML or JSON file. Unknown
+// settings are rejected.
+func (c *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading config %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate rejects settings the server cannot start with
+func (c *config) validate() error {
+	if c.Listen == "" {
+		return errors.New("listen address must not be empty")
+	}
+	if c.TLS.Cert == "" || c.TLS.Key == "" {
+		return errors.New("both a TLS certificate and key are required")
+	}
+	if err := c.Chunks.validate(); err != nil {
+		return err
+	}
+	for _, name := range c.Codecs {
+		if !codec.Known(name) {
+			return fmt.Errorf("unknown codec %q, supported are %s", name, strings.Join(codec.Supported, ", "))
+		}
+	}
+
+	if err := c.Generate.validate(c.Store); err != nil {
+		return err
+	}
+	if c.Synthetic && synthetic.IsName(c.Generate.File) {
+		return fmt.Errorf("generated file %q is shadowed by the synthetic files", c.Generate.File)
+	}
+
+	switch c.Store {
+	case "local":
+		if info, err := os.Stat(c.Root); err != nil || !info.IsDir() {
+			return fmt.Errorf("root %q is not a directory", c.Root)
+		}
+	case "s3":
+		if c.S3.Endpoint == "" || c.S3.Bucket == "" {
+			return errors.New("the s3 store needs an endpoint and a bucket")
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store)
+	}
+	return nil
+}
+
+// validate rejects generation settings the server cannot honour with the
+// given store. Only the local store can have the file written to disk.
+func (g *generateSettings) validate(storeName string) error {
+	if g.File == "" {
+		return nil
+	}
+	if !fs.ValidPath(g.File) || g.File == "." {
+		return fmt.Errorf("generated file %q must be a relative slash-separated path", g.File)
+	}
+	if g.Size <= 0 {
+		return fmt.Errorf("generated file size must be positive, got %d", g.Size)
+	}
+	if _, err := synthetic.NewGenerator(g.Pattern, g.Size, g.Seed); err != nil {
+		return err
+	}
+	if !g.Virtual && storeName != "local" {
+		return fmt.Errorf("the %s store can only serve generated files virtually", storeName)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/4erneff/alcatraz/server/store"
+	"github.com/4erneff/alcatraz/synthetic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// env returns a lookup function over a fixed environment
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+listen: ":6000"
+root: `+root+`
+chunks:
+  default: 262144
+generate:
+  file: ""
+`), 0644))
+
+	cfg, err := loadConfig([]string{"-config", path, "-listen", ":7000"}, env(map[string]string{
+		"ALCATRAZ_LISTEN":         ":8000",
+		"ALCATRAZ_MAX_CHUNK_SIZE": "524288",
+		"ALCATRAZ_CODECS":         "gzip",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, ":7000", cfg.Listen, "Flags should win over the environment and the file")
+	assert.Equal(t, int32(524288), cfg.Chunks.Max, "The environment should win over the defaults")
+	assert.Equal(t, int32(262144), cfg.Chunks.Default, "The file should win over the defaults")
+	assert.Equal(t, int32(minChunkSize), cfg.Chunks.Min)
+	assert.Equal(t, root, cfg.Root)
+	assert.Empty(t, cfg.Generate.File)
+	assert.Equal(t, "server.crt", cfg.TLS.Cert)
+	assert.Equal(t, []string{"gzip"}, cfg.Codecs)
+}
+
+func TestLoadConfig_JSONFromEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"store": "s3", "s3": {"endpoint": "http://localhost:9000", "bucket": "files"}}`), 0644))
+
+	cfg, err := loadConfig(nil, env(map[string]string{"ALCATRAZ_CONFIG": path}))
+	require.NoError(t, err)
+	assert.Equal(t, "s3", cfg.Store)
+	assert.Equal(t, "files", cfg.S3.Bucket)
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	root := t.TempDir()
+	unknownField := filepath.Join(t.TempDir(), "server.yaml")
+	require.NoError(t, os.WriteFile(unknownField, []byte("chunk_size: 1024\n"), 0644))
+
+	tests := map[string][]string{
+		"min above max":         {"-root", root, "-min-chunk-size", "1048576", "-max-chunk-size", "524288"},
+		"default outside range": {"-root", root, "-chunk-size", "4096"},
+		"max above gRPC limit":  {"-root", root, "-max-chunk-size", "8388608"},
+		"missing TLS key":       {"-root", root, "-tls-key", ""},
+		"missing root":          {"-root", filepath.Join(root, "missing")},
+		"generated file escape": {"-root", root, "-generate-file", "../outside.bin"},
+		"s3 without bucket":     {"-store", "s3", "-s3-endpoint", "http://localhost:9000"},
+		"unknown store":         {"-store", "ftp"},
+		"unknown file setting":  {"-root", root, "-config", unknownField},
+		"malformed number":      {"-root", root, "-chunk-size", "1MB"},
+		"unknown codec":         {"-root", root, "-codecs", "zstd,lz4"},
+	}
+	for name, args := range tests {
+		_, err := loadConfig(args, env(nil))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadConfig_Generate(t *testing.T) {
+	root := t.TempDir()
+	cfg, err := loadConfig([]string{"-root", root}, env(nil))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Generate.File, "Generation should be opt-in")
+
+	cfg, err = loadConfig([]string{"-store", "s3", "-s3-endpoint", "http://localhost:9000", "-s3-bucket", "files",
+		"-generate-file", "test/random.bin", "-generate-pattern", "random", "-generate-seed", "42", "-generate-virtual"}, env(nil))
+	require.NoError(t, err, "Virtual files can be served by any store")
+	assert.Equal(t, synthetic.PatternRandom, cfg.Generate.Pattern)
+	assert.Equal(t, int64(42), cfg.Generate.Seed)
+
+	tests := map[string][]string{
+		"unknown pattern":    {"-root", root, "-generate-file", "a.bin", "-generate-pattern", "noise"},
+		"empty file":         {"-root", root, "-generate-file", "a.bin", "-generate-size", "0"},
+		"written to s3":      {"-store", "s3", "-s3-endpoint", "http://localhost:9000", "-s3-bucket", "files", "-generate-file", "a.bin"},
+		"parent directory":   {"-root", root, "-generate-file", "../a.bin", "-generate-virtual"},
+		"absolute file name": {"-root", root, "-generate-file", "/a.bin"},
+		"shadowed file":      {"-root", root, "-synthetic", "-generate-file", "synthetic/a.bin", "-generate-virtual"},
+	}
+	for name, args := range tests {
+		_, err := loadConfig(args, env(nil))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestGenerateTestFile(t *testing.T) {
+	root := t.TempDir()
+	settings := generateSettings{File: "dir/a.bin", Size: 4096, Pattern: synthetic.PatternText, Seed: 1}
+	files, err := generateTestFile(root, store.NewLocal(root), settings)
+	require.NoError(t, err)
+	written, err := os.ReadFile(filepath.Join(root, "dir", "a.bin"))
+	require.NoError(t, err)
+	assert.Len(t, written, 4096)
+
+	settings.File, settings.Virtual = "b.bin", true
+	files, err = generateTestFile(root, files, settings)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(root, "b.bin"))
+	assert.True(t, os.IsNotExist(err), "Virtual files should not be written")
+	r, err := files.Open(context.Background(), "b.bin")
+	require.NoError(t, err)
+	defer r.Close()
+	served, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, written, served, "The same settings should produce the same content")
+}
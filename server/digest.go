@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/4erneff/alcatraz/manifest"
+	"github.com/4erneff/alcatraz/server/store"
+)
+
+// digestCache remembers whole-file checksums and chunk leaf hashes so large
+// files are only hashed once. Entries are keyed by name and chunk size and
+// invalidated when size or modification time change.
+type digestCache struct {
+	mu      sync.Mutex
+	entries map[digestKey]digestEntry
+}
+
+type digestKey struct {
+	name      string
+	chunkSize int32
+}
+
+type digestEntry struct {
+	size     int64
+	modTime  time.Time
+	checksum string   // SHA-256 of the whole file, hex encoded
+	leaves   [][]byte // Merkle leaf hash of every chunk
+	root     []byte   // Merkle tree root over leaves
+}
+
+// fileDigests hashes a file in a single pass, or returns the cached result
+func (s *server) fileDigests(ctx context.Context, info store.FileInfo, chunkSize int32) (digestEntry, error) {
+	key := digestKey{name: info.Name, chunkSize: chunkSize}
+	s.digests.mu.Lock()
+	entry, ok := s.digests.entries[key]
+	s.digests.mu.Unlock()
+	if ok && entry.size == info.Size && entry.modTime.Equal(info.ModTime) {
+		return entry, nil
+	}
+
+	reader, err := s.store.Open(ctx, info.Name)
+	if err != nil {
+		return digestEntry{}, storeError(info.Name, err)
+	}
+	defer reader.Close()
+
+	entry = digestEntry{size: info.Size, modTime: info.ModTime}
+	hash := sha256.New()
+	buffer := make([]byte, chunkSize)
+	for {
+		bytesRead, err := io.ReadFull(reader, buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return digestEntry{}, err
+		}
+		hash.Write(buffer[:bytesRead])
+		entry.leaves = append(entry.leaves, manifest.LeafHash(buffer[:bytesRead]))
+	}
+	entry.checksum = fmt.Sprintf("%x", hash.Sum(nil))
+	entry.root = manifest.RootHash(entry.leaves)
+
+	s.digests.mu.Lock()
+	if s.digests.entries == nil {
+		s.digests.entries = make(map[digestKey]digestEntry)
+	}
+	s.digests.entries[key] = entry
+	s.digests.mu.Unlock()
+	return entry, nil
+}
+
+// fileChecksum returns the hex encoded SHA-256 of a whole file
+func (s *server) fileChecksum(ctx context.Context, info store.FileInfo) (string, error) {
+	entry, err := s.fileDigests(ctx, info, s.chunkLimits().Default)
+	if err != nil {
+		return "", err
+	}
+	return entry.checksum, nil
+}
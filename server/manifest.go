@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"github.com/4erneff/alcatraz/manifest"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxManifestLeaves is the number of leaf hashes sent in one manifest page.
+// 32 bytes and a few bytes of framing each keep a page around 2.2MB, below
+// gRPC's 4MB message limit.
+const maxManifestLeaves = 64 * 1024
+
+// GetManifest returns a page of the Merkle tree manifest of a file, signed
+// when the server has a signing key. The page holds the leaf hashes from
+// StartChunk on, at most maxManifestLeaves of them; every page carries the
+// root over all leaves.
+func (s *server) GetManifest(ctx context.Context, req *pb.ManifestRequest) (*pb.Manifest, error) {
+	fileInfo, err := s.store.Stat(ctx, req.FileId)
+	if err != nil {
+		return nil, storeError(req.FileId, err)
+	}
+	chunkSize := s.negotiateChunkSize(req.ChunkSize)
+	totalChunks := chunkCount(fileInfo.Size, chunkSize)
+	if req.StartChunk < 0 || req.StartChunk > totalChunks {
+		return nil, status.Errorf(codes.OutOfRange, "start chunk %d outside of [0, %d]", req.StartChunk, totalChunks)
+	}
+	entry, err := s.fileDigests(ctx, fileInfo, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	start := min(int(req.StartChunk), len(entry.leaves)) // The file may have changed while it was hashed
+	end := min(start+maxManifestLeaves, len(entry.leaves))
+	m := &pb.Manifest{
+		FileId:      req.FileId,
+		TotalSize:   fileInfo.Size,
+		TotalChunks: totalChunks,
+		ChunkSize:   chunkSize,
+		LeafHashes:  entry.leaves[start:end],
+		RootHash:    entry.root,
+		StartChunk:  req.StartChunk,
+	}
+	if s.signingKey != nil {
+		manifest.Sign(m, s.signingKey)
+	}
+	return m, nil
+}
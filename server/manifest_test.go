@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/4erneff/alcatraz/manifest"
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/server/store"
+)
+
+func TestGetManifest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	data := make([]byte, 2*fileChunkSize+1)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	memStore := store.NewMemory()
+	require.NoError(t, memStore.Add("data.bin", data))
+	s := &server{store: memStore, signingKey: privateKey}
+
+	m, err := s.GetManifest(context.Background(), &pb.ManifestRequest{FileId: "data.bin"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), m.TotalChunks)
+	assert.Equal(t, int32(fileChunkSize), m.ChunkSize)
+	assert.Len(t, m.LeafHashes, 3)
+	assert.NoError(t, manifest.Verify(m, nil, publicKey), "Signed manifest should verify")
+	assert.NoError(t, manifest.VerifyChunk(m, 2, data[2*fileChunkSize:]), "Last chunk should match its leaf")
+
+	unsigned := &server{store: memStore}
+	m2, err := unsigned.GetManifest(context.Background(), &pb.ManifestRequest{FileId: "data.bin"})
+	require.NoError(t, err)
+	assert.Empty(t, m2.Signature, "Servers without a key leave manifests unsigned")
+	assert.NoError(t, manifest.Verify(m2, m.RootHash, nil), "Root should be stable and pinnable")
+
+	_, err = s.GetManifest(context.Background(), &pb.ManifestRequest{FileId: "missing.bin"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGetManifest_Pages(t *testing.T) {
+	// 16 byte chunks make a manifest larger than one page from a small file
+	data := make([]byte, 16*maxManifestLeaves+5)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	memStore := store.NewMemory()
+	require.NoError(t, memStore.Add("data.bin", data))
+	s := &server{store: memStore, chunks: chunkLimits{Default: 16, Min: 16, Max: 16}}
+
+	first, err := s.GetManifest(context.Background(), &pb.ManifestRequest{FileId: "data.bin"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(maxManifestLeaves+1), first.TotalChunks)
+	assert.Len(t, first.LeafHashes, maxManifestLeaves, "A page should hold at most maxManifestLeaves leaves")
+
+	last, err := s.GetManifest(context.Background(), &pb.ManifestRequest{FileId: "data.bin", StartChunk: maxManifestLeaves})
+	require.NoError(t, err)
+	assert.Equal(t, int32(maxManifestLeaves), last.StartChunk)
+	assert.Equal(t, [][]byte{manifest.LeafHash(data[16*maxManifestLeaves:])}, last.LeafHashes)
+	assert.Equal(t, first.RootHash, last.RootHash, "Every page should carry the root over all leaves")
+
+	whole := &pb.Manifest{TotalChunks: first.TotalChunks, LeafHashes: append(first.LeafHashes, last.LeafHashes...), RootHash: first.RootHash}
+	assert.NoError(t, manifest.Verify(whole, first.RootHash, nil), "Pages should add up to the root")
+
+	_, err = s.GetManifest(context.Background(), &pb.ManifestRequest{FileId: "data.bin", StartChunk: maxManifestLeaves + 2})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
@@ -1,143 +1,463 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 
+	"github.com/4erneff/alcatraz/codec"
+	"github.com/4erneff/alcatraz/manifest"
 	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/server/store"
+	"github.com/4erneff/alcatraz/synthetic"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	port          = ":50051"
-	fileChunkSize = 1024 * 1024 // 1MB per chunk
-	filePath      = "large_file.bin"
+	fileChunkSize  = 1024 * 1024     // Default chunk size, 1MB per chunk
+	minChunkSize   = 64 * 1024       // Smallest chunk size a client may ask for
+	maxChunkSize   = 3 * 1024 * 1024 // Largest chunk size a client may ask for, keeps chunks below gRPC's 4MB message limit
+	chunkSizeLimit = maxChunkSize    // Largest chunk size the server can be configured to allow
 )
 
+// chunkLimits bounds the chunk sizes clients may negotiate
+type chunkLimits struct {
+	Default int32 `yaml:"default"` // Used when the client has no preference
+	Min     int32 `yaml:"min"`
+	Max     int32 `yaml:"max"`
+}
+
+// defaultChunkLimits are the chunk sizes of a server that configures none
+var defaultChunkLimits = chunkLimits{Default: fileChunkSize, Min: minChunkSize, Max: maxChunkSize}
+
+// validate rejects limits that are inconsistent or exceed chunkSizeLimit
+func (l chunkLimits) validate() error {
+	switch {
+	case l.Min <= 0:
+		return fmt.Errorf("minimum chunk size must be positive, got %d", l.Min)
+	case l.Min > l.Max:
+		return fmt.Errorf("minimum chunk size %d exceeds the maximum %d", l.Min, l.Max)
+	case l.Max > chunkSizeLimit:
+		return fmt.Errorf("maximum chunk size %d exceeds %d, which keeps chunks below gRPC's message limit", l.Max, chunkSizeLimit)
+	case l.Default < l.Min || l.Default > l.Max:
+		return fmt.Errorf("default chunk size %d is outside [%d, %d]", l.Default, l.Min, l.Max)
+	}
+	return nil
+}
+
 // Server is the gRPC server
 type server struct {
 	pb.UnimplementedFileServiceServer
+
+	store     store.Store     // Backend the published files are read from
+	uploads   *uploadManager  // Sessions of in-progress uploads
+	digests   digestCache     // Whole-file checksums of served files
+	transfers transferManager // Flow-controlled transfers clients can reconnect to
+
+	signingKey ed25519.PrivateKey // Key manifests are signed with, nil to leave them unsigned
+	chunks     chunkLimits        // Chunk sizes clients may negotiate, zero for defaultChunkLimits
+	codecs     []string           // Codecs chunks may be compressed with, nil to always send them raw
 }
 
-// GenerateFile creates a large file (1GB) on the server
-func GenerateFile() error {
-	file, err := os.Create(filePath)
+// GenerateFile writes the content of gen to a file on the server
+func GenerateFile(path string, gen *synthetic.Generator) error {
+	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	// Hide the file's ReadFrom, which would copy through its own 32KB buffer
+	// instead of generating and writing 1MB at a time
 	data := make([]byte, 1024*1024) // 1MB buffer
-	for i := 0; i < 1024; i++ {     // Write 1024MB to make 1GB
-		if _, err := file.Write(data); err != nil {
-			return err
-		}
+	if _, err := io.CopyBuffer(struct{ io.Writer }{file}, io.NewSectionReader(gen, 0, gen.Size()), data); err != nil {
+		return err
 	}
+	return file.Close()
+}
 
-	return nil
+// chunkChecksum returns the hex encoded SHA-256 of a chunk
+func chunkChecksum(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
 }
 
-// GetFileMetadata returns the total size and total number of chunks
+// chunkCount returns the number of chunks a file of the given size is divided into
+func chunkCount(totalSize int64, chunkSize int32) int32 {
+	return int32((totalSize + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+// chunkLimits returns the chunk sizes the server allows
+func (s *server) chunkLimits() chunkLimits {
+	if s.chunks == (chunkLimits{}) {
+		return defaultChunkLimits
+	}
+	return s.chunks
+}
+
+// negotiateChunkSize returns the chunk size used for a request: the server
+// default when the client has no preference, otherwise the requested size
+// clamped to the server's bounds
+func (s *server) negotiateChunkSize(requested int32) int32 {
+	limits := s.chunkLimits()
+	switch {
+	case requested == 0:
+		return limits.Default
+	case requested < limits.Min:
+		return limits.Min
+	case requested > limits.Max:
+		return limits.Max
+	}
+	return requested
+}
+
+// GetFileMetadata returns the total size and total number of chunks. The
+// whole-file checksum is only computed when the request asks for it, as it
+// reads the entire file before the first byte can be served.
 func (s *server) GetFileMetadata(
 	ctx context.Context,
 	req *pb.FileMetadataRequest,
 ) (*pb.FileMetadataResponse, error) {
-	fileInfo, err := os.Stat(filePath)
+	fileInfo, err := s.store.Stat(ctx, req.FileId)
 	if err != nil {
-		return nil, err
+		return nil, storeError(req.FileId, err)
 	}
 
-	totalSize := fileInfo.Size()
-	totalChunks := int32((totalSize + int64(fileChunkSize) - 1) / int64(fileChunkSize)) // Calculate total number of chunks
+	chunkSize := s.negotiateChunkSize(req.ChunkSize)
+	totalSize := fileInfo.Size
+	totalChunks := chunkCount(totalSize, chunkSize) // Calculate total number of chunks
+
+	var fileChecksum string
+	if req.Checksum {
+		if fileChecksum, err = s.fileChecksum(ctx, fileInfo); err != nil {
+			return nil, err
+		}
+	}
 
 	return &pb.FileMetadataResponse{
-		TotalSize:   totalSize,
-		TotalChunks: totalChunks,
+		TotalSize:    totalSize,
+		TotalChunks:  totalChunks,
+		FileChecksum: fileChecksum,
+		ChunkSize:    chunkSize,
 	}, nil
 }
 
-// GetFileStream sends the file in chunks to the client
+// GetFileStream sends the file in chunks to the client. The client either
+// asks for whole chunks [StartChunk, EndChunk), for a list of such chunk
+// Ranges or for the byte range [Offset, Offset+Length).
 func (s *server) GetFileStream(req *pb.FileRequest, stream pb.FileService_GetFileStreamServer) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	ctx := stream.Context()
 
 	// Get the total size of the file
-	fileInfo, err := file.Stat()
+	fileInfo, err := s.store.Stat(ctx, req.FileId)
 	if err != nil {
-		return err
+		return storeError(req.FileId, err)
 	}
-	totalSize := fileInfo.Size()
+	totalSize := fileInfo.Size
+	chunkSize := s.negotiateChunkSize(req.ChunkSize)
+	opts := s.sendOptions(req.Sparse, req.Codecs)
 
-	// Calculate total number of chunks
-	totalChunks := int32((totalSize + int64(fileChunkSize) - 1) / int64(fileChunkSize))
-
-	buffer := make([]byte, fileChunkSize)
-	sequenceNumber := req.StartChunk
+	if len(req.Ranges) > 0 {
+		ranges, err := requestedChunkRanges(req, totalSize, chunkSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges {
+			if err := s.sendRange(ctx, req.FileId, r[0], r[1], totalSize, chunkSize, opts, stream.Send); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-	_, err = file.Seek(int64(sequenceNumber)*int64(fileChunkSize), io.SeekStart)
+	start, end, err := requestedRange(req, totalSize, chunkSize)
 	if err != nil {
 		return err
 	}
+	return s.sendRange(ctx, req.FileId, start, end, totalSize, chunkSize, opts, stream.Send)
+}
 
-	for {
-		bytesRead, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
+// requestedChunkRanges returns the byte ranges [start, end) of the chunk
+// ranges a file request lists, in ascending order with overlapping and
+// adjacent ranges merged
+func requestedChunkRanges(req *pb.FileRequest, totalSize int64, chunkSize int32) ([][2]int64, error) {
+	if req.StartChunk != 0 || req.EndChunk != 0 || req.Offset != 0 || req.Length != 0 {
+		return nil, status.Error(codes.InvalidArgument, "a request selects either chunk ranges, one chunk range or a byte range")
+	}
+
+	totalChunks := chunkCount(totalSize, chunkSize)
+	chunkRanges := make([]*pb.ChunkRange, len(req.Ranges))
+	copy(chunkRanges, req.Ranges)
+	sort.Slice(chunkRanges, func(i, j int) bool { return chunkRanges[i].StartChunk < chunkRanges[j].StartChunk })
+
+	var ranges [][2]int64
+	for _, r := range chunkRanges {
+		if r.StartChunk < 0 || r.EndChunk <= r.StartChunk {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid chunk range [%d, %d)", r.StartChunk, r.EndChunk)
+		}
+		if r.EndChunk > totalChunks {
+			return nil, status.Errorf(codes.OutOfRange, "chunk range [%d, %d) is past the last chunk (%d chunks)", r.StartChunk, r.EndChunk, totalChunks)
+		}
+		start := int64(r.StartChunk) * int64(chunkSize)
+		end := int64(r.EndChunk) * int64(chunkSize)
+		if end > totalSize {
+			end = totalSize
+		}
+		if n := len(ranges); n > 0 && start <= ranges[n-1][1] {
+			if end > ranges[n-1][1] {
+				ranges[n-1][1] = end
 			}
-			return err
+			continue
+		}
+		ranges = append(ranges, [2]int64{start, end})
+	}
+	return ranges, nil
+}
+
+// requestedRange returns the byte range [start, end) a file request asks for
+func requestedRange(req *pb.FileRequest, totalSize int64, chunkSize int32) (int64, int64, error) {
+	if req.Offset != 0 || req.Length != 0 {
+		if req.StartChunk != 0 || req.EndChunk != 0 {
+			return 0, 0, status.Error(codes.InvalidArgument, "a request selects either chunks or a byte range, not both")
+		}
+		if req.Offset < 0 || req.Length < 0 {
+			return 0, 0, status.Errorf(codes.InvalidArgument, "invalid byte range offset %d length %d", req.Offset, req.Length)
+		}
+		if req.Offset > totalSize {
+			return 0, 0, status.Errorf(codes.OutOfRange, "offset %d is past the end of the file (%d bytes)", req.Offset, totalSize)
+		}
+		end := totalSize
+		if req.Length > 0 && req.Length < totalSize-req.Offset { // Offset+Length could overflow
+			end = req.Offset + req.Length
+		}
+		return req.Offset, end, nil
+	}
+
+	totalChunks := chunkCount(totalSize, chunkSize)
+	if req.StartChunk < 0 || req.EndChunk < 0 || (req.EndChunk != 0 && req.EndChunk < req.StartChunk) {
+		return 0, 0, status.Errorf(codes.InvalidArgument, "invalid chunk range [%d, %d)", req.StartChunk, req.EndChunk)
+	}
+	if req.StartChunk > totalChunks {
+		return 0, 0, status.Errorf(codes.OutOfRange, "start chunk %d is past the last chunk (%d chunks)", req.StartChunk, totalChunks)
+	}
+	end := totalSize
+	if req.EndChunk != 0 && int64(req.EndChunk)*int64(chunkSize) < totalSize {
+		end = int64(req.EndChunk) * int64(chunkSize)
+	}
+	return int64(req.StartChunk) * int64(chunkSize), end, nil
+}
+
+// sendOptions selects how sendRange encodes the chunks it sends
+type sendOptions struct {
+	sparse bool   // Send all-zero data as zero_length markers
+	codec  string // Codec to compress data with, codec.None to send it raw
+}
+
+// sendOptions returns the options of a stream whose client accepts
+// zero_length markers if sparse is set and can decode the offered codecs
+func (s *server) sendOptions(sparse bool, offered []string) sendOptions {
+	return sendOptions{sparse: sparse, codec: codec.Negotiate(offered, s.codecs)}
+}
+
+// sendRange streams the bytes [start, end) of a file. Data is split on chunk
+// boundaries, so every message belongs to exactly one chunk; only the first
+// and last message of an unaligned range carry part of a chunk.
+//
+// With opts.sparse set, data that is all zeros is sent as a zero_length
+// marker instead of the bytes and their checksum. Holes the store knows about
+// are not even read. Other data is compressed with opts.codec when that
+// shrinks it.
+func (s *server) sendRange(ctx context.Context, fileID string, start, end, totalSize int64, chunkSize int32, opts sendOptions, send func(*pb.FileChunk) error) error {
+	totalChunks := chunkCount(totalSize, chunkSize)
+	buffer := make([]byte, chunkSize)
+
+	var holes [][2]int64
+	var zeros []byte
+	if opts.sparse {
+		var err error
+		if holes, err = store.Holes(ctx, s.store, fileID, start, end); err != nil {
+			return storeError(fileID, err)
+		}
+		zeros = make([]byte, chunkSize)
+	}
+
+	var reader io.ReadCloser
+	readerOffset := int64(-1) // Position of reader in the file
+	defer func() {
+		if reader != nil {
+			reader.Close()
+		}
+	}()
+
+	for offset := start; offset < end; {
+		sequenceNumber := int32(offset / int64(chunkSize))
+		size := (int64(sequenceNumber)+1)*int64(chunkSize) - offset
+		if size > end-offset {
+			size = end - offset
 		}
 
-		checksum := sha256.Sum256(buffer[:bytesRead])
 		chunk := &pb.FileChunk{
 			SequenceNumber: sequenceNumber,
-			ChunkData:      buffer[:bytesRead],
-			Checksum:       fmt.Sprintf("%x", checksum),
 			TotalSize:      totalSize,
 			TotalChunks:    totalChunks,
+			ChunkSize:      chunkSize,
+			Offset:         offset,
 		}
 
-		if err := stream.Send(chunk); err != nil {
+		for len(holes) > 0 && holes[0][1] <= offset {
+			holes = holes[1:]
+		}
+		if len(holes) > 0 && holes[0][0] <= offset && holes[0][1] >= offset+size {
+			chunk.ZeroLength = size
+		} else {
+			if readerOffset != offset {
+				// Skipped a hole, continue reading after it
+				if reader != nil {
+					reader.Close()
+				}
+				var err error
+				if reader, err = s.store.ReadRange(ctx, fileID, offset, end-offset); err != nil {
+					return storeError(fileID, err)
+				}
+				readerOffset = offset
+			}
+
+			data := buffer[:size]
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return fmt.Errorf("reading %s at offset %d: %w", fileID, offset, err)
+			}
+			readerOffset += size
+
+			if opts.sparse && bytes.Equal(data, zeros[:size]) {
+				chunk.ZeroLength = size
+			} else {
+				chunk.ChunkData = data
+				chunk.Checksum = chunkChecksum(data)
+				if opts.codec != codec.None {
+					compressed, err := codec.Compress(opts.codec, data)
+					if err != nil {
+						return fmt.Errorf("compressing %s at offset %d: %w", fileID, offset, err)
+					}
+					if len(compressed) < len(data) {
+						chunk.ChunkData, chunk.Codec = compressed, opts.codec
+					}
+				}
+			}
+		}
+
+		if err := send(chunk); err != nil {
 			return err
 		}
 
-		sequenceNumber++
+		offset += size
 	}
 
 	return nil
 }
 
 func main() {
-	// Generate the large file on the server
-	if err := GenerateFile(); err != nil {
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	var fileStore store.Store
+	switch cfg.Store {
+	case "local":
+		fileStore = store.NewLocal(cfg.Root)
+	case "s3":
+		s3Store, err := store.NewS3(store.S3Config{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			Prefix:    cfg.S3.Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+		if err != nil {
+			log.Fatalf("Failed to configure S3 store: %v", err)
+		}
+		fileStore = s3Store
+	}
+	if fileStore, err = generateTestFile(cfg.Root, fileStore, cfg.Generate); err != nil {
 		log.Fatalf("Failed to generate file: %v", err)
 	}
-	fmt.Println("File generated successfully")
+	if cfg.Synthetic {
+		fileStore = store.NewSynthetic(fileStore)
+	}
+
+	uploads, err := newUploadManager(cfg.UploadDir, fileStore)
+	if err != nil {
+		log.Fatalf("Failed to prepare upload directory: %v", err)
+	}
+
+	var signingKey ed25519.PrivateKey
+	if cfg.ManifestKey != "" {
+		if signingKey, err = manifest.LoadPrivateKey(cfg.ManifestKey); err != nil {
+			log.Fatalf("Failed to load manifest signing key: %v", err)
+		}
+	}
 
-	creds, err := credentials.NewServerTLSFromFile("server.crt", "server.key")
+	creds, err := credentials.NewServerTLSFromFile(cfg.TLS.Cert, cfg.TLS.Key)
 	if err != nil {
 		log.Fatalf("Failed to load TLS keys: %v", err)
 	}
 
-	lis, err := net.Listen("tcp", port)
+	lis, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
 	s := grpc.NewServer(grpc.Creds(creds))
-	pb.RegisterFileServiceServer(s, &server{})
+	pb.RegisterFileServiceServer(s, &server{store: fileStore, uploads: uploads, signingKey: signingKey, chunks: cfg.Chunks, codecs: cfg.Codecs})
 
-	log.Printf("Server listening on %s", port)
+	log.Printf("Server listening on %s (%s store)", cfg.Listen, cfg.Store)
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 }
+
+// generateTestFile sets up the synthetic test file described by settings.
+// A virtual file is served by wrapping files, any other is written below the
+// root of the local store unless it exists and is not to be overwritten.
+func generateTestFile(root string, files store.Store, settings generateSettings) (store.Store, error) {
+	if settings.File == "" {
+		return files, nil
+	}
+	gen, err := synthetic.NewGenerator(settings.Pattern, settings.Size, settings.Seed)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Virtual {
+		log.Printf("Serving generated %s (%d bytes of %s, seed %d)", settings.File, settings.Size, settings.Pattern, settings.Seed)
+		return store.NewGenerated(files, settings.File, gen)
+	}
+
+	path := filepath.Join(root, filepath.FromSlash(settings.File))
+	if _, err := os.Stat(path); err == nil && !settings.Overwrite {
+		return files, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := GenerateFile(path, gen); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated %s (%d bytes of %s, seed %d)", path, settings.Size, settings.Pattern, settings.Seed)
+	return files, nil
+}
@@ -1,23 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 
+	"github.com/4erneff/alcatraz/codec"
 	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/server/store"
+	"github.com/4erneff/alcatraz/synthetic"
 )
 
 const bufSize = 1024 * 1024
 
+// filePath is the file generated for the tests, relative to the working directory
+const filePath = "large_file.bin"
+
 var lis *bufconn.Listener
 
 // Initialize in-memory gRPC server using bufconn for testing.
@@ -27,7 +38,7 @@ func init() {
 	s := grpc.NewServer()
 
 	// Register the service
-	pb.RegisterFileServiceServer(s, &server{})
+	pb.RegisterFileServiceServer(s, &server{store: store.NewLocal(".")})
 
 	go func() {
 		if err := s.Serve(lis); err != nil {
@@ -41,11 +52,17 @@ func bufDialer(context.Context, string) (net.Conn, error) {
 	return lis.Dial()
 }
 
+// zeros returns a generator of a zero-filled file of size bytes
+func zeros(size int64) *synthetic.Generator {
+	gen, _ := synthetic.NewGenerator(synthetic.PatternZeros, size, 0)
+	return gen
+}
+
 func TestGenerateFile(t *testing.T) {
 	// Clean up after the test
 	defer os.Remove(filePath)
 
-	err := GenerateFile()
+	err := GenerateFile(filePath, zeros(1024*1024*1024))
 	assert.NoError(t, err, "File should be generated without error")
 
 	// Check file existence and size
@@ -56,7 +73,7 @@ func TestGenerateFile(t *testing.T) {
 
 func TestGetFileMetadata(t *testing.T) {
 	// Ensure the file exists for the test
-	err := GenerateFile()
+	err := GenerateFile(filePath, zeros(1024*1024*1024))
 	assert.NoError(t, err)
 	defer os.Remove(filePath)
 
@@ -67,15 +84,34 @@ func TestGetFileMetadata(t *testing.T) {
 	client := pb.NewFileServiceClient(conn)
 
 	// Call GetFileMetadata
-	resp, err := client.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{})
+	resp, err := client.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{FileId: filePath, Checksum: true})
 	assert.NoError(t, err, "Metadata retrieval should succeed")
 	assert.Equal(t, int64(1024*1024*1024), resp.TotalSize, "Total size should be 1GB")
 	assert.Equal(t, int32(1024), resp.TotalChunks, "Total chunks should be 1024")
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(make([]byte, 1024*1024*1024))), resp.FileChecksum, "File checksum should cover the whole file")
+}
+
+func TestGetFileMetadata_ChecksumFollowsContent(t *testing.T) {
+	memStore := store.NewMemory()
+	s := &server{store: memStore}
+
+	assert.NoError(t, memStore.Add("a.bin", []byte("first")))
+	resp, err := s.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{FileId: "a.bin"})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.FileChecksum, "File checksum should only be computed on request")
+	resp, err = s.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{FileId: "a.bin", Checksum: true})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("first"))), resp.FileChecksum)
+
+	assert.NoError(t, memStore.Add("a.bin", []byte("second")))
+	resp, err = s.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{FileId: "a.bin", Checksum: true})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("second"))), resp.FileChecksum, "Cached checksum should be refreshed when the file changes")
 }
 
 func TestGetFileStream(t *testing.T) {
 	// Ensure the file exists for the test
-	err := GenerateFile()
+	err := GenerateFile(filePath, zeros(1024*1024*1024))
 	assert.NoError(t, err)
 	defer os.Remove(filePath)
 
@@ -86,7 +122,7 @@ func TestGetFileStream(t *testing.T) {
 	client := pb.NewFileServiceClient(conn)
 
 	// Request the file stream starting at chunk 0
-	stream, err := client.GetFileStream(context.Background(), &pb.FileRequest{StartChunk: 0})
+	stream, err := client.GetFileStream(context.Background(), &pb.FileRequest{StartChunk: 0, FileId: filePath})
 	assert.NoError(t, err, "File stream request should succeed")
 
 	chunk, err := stream.Recv()
@@ -110,3 +146,296 @@ func TestGetFileStream(t *testing.T) {
 
 	assert.Equal(t, 1024, totalChunksReceived, "Should receive 1024 chunks in total")
 }
+
+func TestListFiles(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(root+"/builds/42", 0755))
+	assert.NoError(t, os.WriteFile(root+"/builds/42/app.tar", make([]byte, fileChunkSize+1), 0644))
+	assert.NoError(t, os.WriteFile(root+"/notes.txt", []byte("hello"), 0644))
+
+	s := &server{store: store.NewLocal(root)}
+	resp, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{})
+	assert.NoError(t, err, "Listing should succeed")
+	assert.Len(t, resp.Files, 2, "Both files should be listed")
+	assert.Equal(t, "builds/42/app.tar", resp.Files[0].FileId)
+	assert.Equal(t, int64(fileChunkSize+1), resp.Files[0].TotalSize)
+	assert.Equal(t, int32(2), resp.Files[0].TotalChunks)
+	assert.Equal(t, "notes.txt", resp.Files[1].FileId)
+	assert.Equal(t, int32(1), resp.Files[1].TotalChunks)
+}
+
+func TestGetFileMetadata_InvalidFileID(t *testing.T) {
+	s := &server{store: store.NewLocal(t.TempDir())}
+
+	for _, id := range []string{"", ".", "../etc/passwd", "/etc/passwd", "a/../../b"} {
+		_, err := s.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{FileId: id})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "File id %q should be rejected", id)
+	}
+
+	_, err := s.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{FileId: "missing.bin"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Missing file should be reported as not found")
+}
+
+func TestGetFileStream_MemoryStore(t *testing.T) {
+	data := make([]byte, 2*fileChunkSize+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	memStore := store.NewMemory()
+	assert.NoError(t, memStore.Add("dir/data.bin", data))
+	s := &server{store: memStore}
+
+	stream := &collectStream{ctx: context.Background()}
+	err := s.GetFileStream(&pb.FileRequest{FileId: "dir/data.bin", StartChunk: 1}, stream)
+	assert.NoError(t, err, "Streaming from the memory store should succeed")
+	assert.Len(t, stream.chunks, 2, "Chunks 1 and 2 should be sent")
+	assert.Equal(t, int32(1), stream.chunks[0].SequenceNumber)
+	assert.Equal(t, data[fileChunkSize:2*fileChunkSize], stream.chunks[0].ChunkData)
+	assert.Equal(t, data[2*fileChunkSize:], stream.chunks[1].ChunkData, "Last chunk should hold the remainder")
+	assert.Equal(t, int32(3), stream.chunks[1].TotalChunks)
+}
+
+// collectStream is a FileService_GetFileStreamServer that records sent chunks
+type collectStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	chunks []*pb.FileChunk
+}
+
+func (c *collectStream) Context() context.Context { return c.ctx }
+
+func (c *collectStream) Send(chunk *pb.FileChunk) error {
+	chunk.ChunkData = append([]byte(nil), chunk.ChunkData...) // The server reuses its buffer
+	c.chunks = append(c.chunks, chunk)
+	return nil
+}
+
+// holeStore is a memory store reporting fixed holes and recording where reads start
+type holeStore struct {
+	*store.Memory
+	holes [][2]int64
+	reads []int64
+}
+
+func (h *holeStore) Holes(ctx context.Context, name string, start, end int64) ([][2]int64, error) {
+	return h.holes, nil
+}
+
+func (h *holeStore) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	h.reads = append(h.reads, offset)
+	return h.Memory.ReadRange(ctx, name, offset, length)
+}
+
+func TestGetFileStream_Sparse(t *testing.T) {
+	const chunk = 64 * 1024
+	data := make([]byte, 5*chunk+10)
+	for i := 2 * chunk; i < 3*chunk; i++ {
+		data[i] = byte(i)
+	}
+	data[len(data)-1] = 1
+	files := &holeStore{Memory: store.NewMemory(), holes: [][2]int64{{0, chunk + 100}}}
+	assert.NoError(t, files.Add("disk.img", data))
+	s := &server{store: files}
+
+	stream := &collectStream{ctx: context.Background()}
+	err := s.GetFileStream(&pb.FileRequest{FileId: "disk.img", ChunkSize: chunk, Sparse: true}, stream)
+	assert.NoError(t, err)
+	assert.Len(t, stream.chunks, 6)
+	for _, c := range stream.chunks {
+		length := int64(chunk)
+		if c.SequenceNumber == 5 {
+			length = 10
+		}
+		switch c.SequenceNumber {
+		case 2, 5:
+			assert.Equal(t, data[c.Offset:c.Offset+length], c.ChunkData, "Chunk %d holds data", c.SequenceNumber)
+			assert.Zero(t, c.ZeroLength)
+		default:
+			assert.Empty(t, c.ChunkData, "Chunk %d should be sent as a marker", c.SequenceNumber)
+			assert.Empty(t, c.Checksum)
+			assert.Equal(t, length, c.ZeroLength)
+		}
+	}
+	assert.Equal(t, []int64{chunk}, files.reads, "The hole should not be read")
+
+	files.reads = nil
+	stream = &collectStream{ctx: context.Background()}
+	err = s.GetFileStream(&pb.FileRequest{FileId: "disk.img", ChunkSize: chunk}, stream)
+	assert.NoError(t, err)
+	for _, c := range stream.chunks {
+		assert.Zero(t, c.ZeroLength, "Zeros should only be elided on sparse requests")
+		assert.NotEmpty(t, c.ChunkData)
+	}
+	assert.Equal(t, []int64{0}, files.reads)
+}
+
+func TestGetFileStream_Compression(t *testing.T) {
+	const chunk = 64 * 1024
+	data := bytes.Repeat([]byte("GET /index.html 200\n"), 2*chunk/20+1)[:2*chunk]
+	_, err := rand.Read(data[chunk:])
+	assert.NoError(t, err)
+	memStore := store.NewMemory()
+	assert.NoError(t, memStore.Add("access.log", data))
+	s := &server{store: memStore, codecs: codec.Supported}
+
+	stream := &collectStream{ctx: context.Background()}
+	err = s.GetFileStream(&pb.FileRequest{FileId: "access.log", ChunkSize: chunk, Codecs: []string{"lz4", codec.Gzip}}, stream)
+	assert.NoError(t, err)
+	assert.Len(t, stream.chunks, 2)
+
+	text := stream.chunks[0]
+	assert.Equal(t, codec.Gzip, text.Codec, "The first codec both sides know should be used")
+	assert.Less(t, len(text.ChunkData), chunk/10)
+	decompressed, err := codec.Decompress(text.Codec, text.ChunkData, chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, data[:chunk], decompressed)
+	assert.Equal(t, chunkChecksum(data[:chunk]), text.Checksum, "The checksum should cover the uncompressed bytes")
+
+	random := stream.chunks[1]
+	assert.Empty(t, random.Codec, "Chunks that do not shrink should be sent raw")
+	assert.Equal(t, data[chunk:], random.ChunkData)
+
+	stream = &collectStream{ctx: context.Background()}
+	err = s.GetFileStream(&pb.FileRequest{FileId: "access.log", ChunkSize: chunk}, stream)
+	assert.NoError(t, err)
+	assert.Empty(t, stream.chunks[0].Codec, "Chunks should only be compressed for clients offering a codec")
+}
+
+func TestNegotiateChunkSize(t *testing.T) {
+	srv := &server{}
+	assert.Equal(t, int32(fileChunkSize), srv.negotiateChunkSize(0), "No preference should use the default")
+	assert.Equal(t, int32(minChunkSize), srv.negotiateChunkSize(1), "Tiny chunks should be raised to the minimum")
+	assert.Equal(t, int32(maxChunkSize), srv.negotiateChunkSize(64*1024*1024), "Huge chunks should be capped")
+	assert.Equal(t, int32(128*1024), srv.negotiateChunkSize(128*1024))
+
+	srv.chunks = chunkLimits{Default: 256 * 1024, Min: 128 * 1024, Max: 512 * 1024}
+	assert.Equal(t, int32(256*1024), srv.negotiateChunkSize(0), "No preference should use the configured default")
+	assert.Equal(t, int32(128*1024), srv.negotiateChunkSize(64*1024), "Chunks should be raised to the configured minimum")
+	assert.Equal(t, int32(512*1024), srv.negotiateChunkSize(1024*1024), "Chunks should be capped at the configured maximum")
+}
+
+func TestGetFileStream_NegotiatedChunkSize(t *testing.T) {
+	data := make([]byte, 300*1024)
+	memStore := store.NewMemory()
+	assert.NoError(t, memStore.Add("data.bin", data))
+	s := &server{store: memStore}
+
+	meta, err := s.GetFileMetadata(context.Background(), &pb.FileMetadataRequest{FileId: "data.bin", ChunkSize: 128 * 1024})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(128*1024), meta.ChunkSize, "Metadata should echo the chunk size")
+	assert.Equal(t, int32(3), meta.TotalChunks)
+
+	stream := &collectStream{ctx: context.Background()}
+	err = s.GetFileStream(&pb.FileRequest{FileId: "data.bin", StartChunk: 1, ChunkSize: 128 * 1024}, stream)
+	assert.NoError(t, err)
+	assert.Len(t, stream.chunks, 2)
+	for _, chunk := range stream.chunks {
+		assert.Equal(t, int32(128*1024), chunk.ChunkSize, "Every chunk should carry the chunk size used")
+	}
+	assert.Len(t, stream.chunks[1].ChunkData, 300*1024-2*128*1024)
+}
+
+func TestGetFileStream_Ranges(t *testing.T) {
+	const chunk = 64 * 1024
+	data := make([]byte, 5*chunk+100)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	memStore := store.NewMemory()
+	assert.NoError(t, memStore.Add("data.bin", data))
+	s := &server{store: memStore}
+
+	collect := func(req *pb.FileRequest) ([]*pb.FileChunk, error) {
+		req.FileId = "data.bin"
+		req.ChunkSize = chunk
+		stream := &collectStream{ctx: context.Background()}
+		err := s.GetFileStream(req, stream)
+		for _, c := range stream.chunks {
+			assert.Equal(t, chunkChecksum(c.ChunkData), c.Checksum, "Checksum should cover the data sent")
+			assert.Equal(t, c.Offset/chunk, int64(c.SequenceNumber), "Data should lie inside its chunk")
+		}
+		return stream.chunks, err
+	}
+	joined := func(chunks []*pb.FileChunk) []byte {
+		var out []byte
+		for _, c := range chunks {
+			out = append(out, c.ChunkData...)
+		}
+		return out
+	}
+
+	// Chunks [1, 3)
+	chunks, err := collect(&pb.FileRequest{StartChunk: 1, EndChunk: 3})
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 2)
+	assert.Equal(t, data[chunk:3*chunk], joined(chunks))
+
+	// An unaligned byte range is split on chunk boundaries
+	chunks, err = collect(&pb.FileRequest{Offset: chunk - 10, Length: chunk + 20})
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 3)
+	assert.Equal(t, int64(chunk-10), chunks[0].Offset)
+	assert.Equal(t, []int32{0, 1, 2}, []int32{chunks[0].SequenceNumber, chunks[1].SequenceNumber, chunks[2].SequenceNumber})
+	assert.Equal(t, data[chunk-10:2*chunk+10], joined(chunks))
+
+	// The tail of the file, and a length running past the end
+	chunks, err = collect(&pb.FileRequest{Offset: int64(len(data)) - 50})
+	assert.NoError(t, err)
+	assert.Equal(t, data[len(data)-50:], joined(chunks))
+	chunks, err = collect(&pb.FileRequest{Offset: int64(len(data)) - 50, Length: 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, data[len(data)-50:], joined(chunks))
+	chunks, err = collect(&pb.FileRequest{Offset: int64(len(data)) - 50, Length: math.MaxInt64})
+	assert.NoError(t, err, "A length reaching past the largest offset should not overflow")
+	assert.Equal(t, data[len(data)-50:], joined(chunks))
+
+	_, err = collect(&pb.FileRequest{Offset: int64(len(data)) + 1})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	_, err = collect(&pb.FileRequest{StartChunk: 1, Offset: 5})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = collect(&pb.FileRequest{StartChunk: 3, EndChunk: 2})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = collect(&pb.FileRequest{StartChunk: 7})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func TestGetFileStream_ChunkRanges(t *testing.T) {
+	const chunk = 64 * 1024
+	data := make([]byte, 6*chunk+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	memStore := store.NewMemory()
+	assert.NoError(t, memStore.Add("data.bin", data))
+	s := &server{store: memStore}
+
+	collect := func(ranges ...*pb.ChunkRange) ([]int32, error) {
+		stream := &collectStream{ctx: context.Background()}
+		err := s.GetFileStream(&pb.FileRequest{FileId: "data.bin", ChunkSize: chunk, Ranges: ranges}, stream)
+		var seqs []int32
+		for _, c := range stream.chunks {
+			seq := c.SequenceNumber
+			end := int64(seq+1) * chunk
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			assert.Equal(t, data[int64(seq)*chunk:end], c.ChunkData, "Chunk %d should hold its data", seq)
+			seqs = append(seqs, seq)
+		}
+		return seqs, err
+	}
+
+	// Holes are sent in ascending order, overlapping ranges only once
+	seqs, err := collect(&pb.ChunkRange{StartChunk: 5, EndChunk: 7}, &pb.ChunkRange{StartChunk: 1, EndChunk: 3}, &pb.ChunkRange{StartChunk: 2, EndChunk: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, []int32{1, 2, 3, 5, 6}, seqs)
+
+	_, err = collect(&pb.ChunkRange{StartChunk: 2, EndChunk: 2})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Empty ranges should be rejected")
+	_, err = collect(&pb.ChunkRange{StartChunk: 6, EndChunk: 8})
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "Ranges past the last chunk should be rejected")
+
+	stream := &collectStream{ctx: context.Background()}
+	err = s.GetFileStream(&pb.FileRequest{FileId: "data.bin", StartChunk: 1, Ranges: []*pb.ChunkRange{{StartChunk: 2, EndChunk: 3}}}, stream)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Ranges cannot be combined with a start chunk")
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sort"
+
+	"github.com/4erneff/alcatraz/synthetic"
+)
+
+// Generated serves a generated file on top of another store without
+// writing it anywhere. Every other name is passed through to the base store.
+type Generated struct {
+	base Store
+	name string
+	gen  *synthetic.Generator
+}
+
+// NewGenerated returns base with the content of gen served under name
+func NewGenerated(base Store, name string, gen *synthetic.Generator) (*Generated, error) {
+	if err := validName("generate", name); err != nil {
+		return nil, err
+	}
+	return &Generated{base: base, name: name, gen: gen}, nil
+}
+
+func (g *Generated) info() FileInfo {
+	return FileInfo{Name: g.name, Size: g.gen.Size()}
+}
+
+// Stat returns information about the named file
+func (g *Generated) Stat(ctx context.Context, name string) (FileInfo, error) {
+	if name == g.name {
+		return g.info(), nil
+	}
+	return g.base.Stat(ctx, name)
+}
+
+// List returns the files of the base store and the generated file
+func (g *Generated) List(ctx context.Context) ([]FileInfo, error) {
+	files, err := g.base.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listed := []FileInfo{g.info()}
+	for _, file := range files {
+		if file.Name != g.name {
+			listed = append(listed, file)
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Name < listed[j].Name })
+	return listed, nil
+}
+
+// Open opens the named file for reading
+func (g *Generated) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return g.ReadRange(ctx, name, 0, -1)
+}
+
+// ReadRange returns a reader over a byte range of the named file
+func (g *Generated) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if name != g.name {
+		return g.base.ReadRange(ctx, name, offset, length)
+	}
+	return generatedRange(g.gen, name, offset, length)
+}
+
+// generatedRange returns a reader over a byte range of generated content
+func generatedRange(gen *synthetic.Generator, name string, offset, length int64) (io.ReadCloser, error) {
+	if err := validRange(name, offset); err != nil {
+		return nil, err
+	}
+	size := gen.Size()
+	if offset > size {
+		offset = size
+	}
+	end := size
+	if length >= 0 && length < size-offset {
+		end = offset + length
+	}
+	return io.NopCloser(io.NewSectionReader(gen, offset, end-offset)), nil
+}
+
+// Put stores a file in the base store. The generated file cannot be replaced.
+func (g *Generated) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if name == g.name {
+		return &fs.PathError{Op: "put", Path: name, Err: fs.ErrPermission}
+	}
+	return g.base.Put(ctx, name, r, size)
+}
+
+// Holes returns the holes of a file of the base store. The generated file has none.
+func (g *Generated) Holes(ctx context.Context, name string, start, end int64) ([][2]int64, error) {
+	if name == g.name {
+		return nil, nil
+	}
+	return Holes(ctx, g.base, name, start, end)
+}
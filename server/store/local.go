@@ -0,0 +1,233 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localTempDir is the directory below the root Put writes its temporary
+// files to. It is not part of the store.
+const localTempDir = ".store-tmp"
+
+// Local serves files from a directory on the local filesystem. Symlinks are
+// followed as long as they resolve to a path below the root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a store serving every regular file below root
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// Root returns the directory the store serves
+func (l *Local) Root() string {
+	return l.root
+}
+
+// path maps a store name onto a path below the root directory
+func (l *Local) path(op, name string) (string, error) {
+	if err := validName(op, name); err != nil {
+		return "", err
+	}
+	if first, _, _ := strings.Cut(name, "/"); first == localTempDir {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(l.root, filepath.FromSlash(name)), nil
+}
+
+// resolve follows the symlinks of path, which must exist, and returns the
+// result. It reports false if that lies outside the root directory or in
+// its temporary directory.
+func (l *Local) resolve(path string) (string, bool, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", false, err
+	}
+	root, err := filepath.EvalSymlinks(l.root)
+	if err != nil {
+		return "", false, err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return "", false, nil
+	}
+	first, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return resolved, first != ".." && first != localTempDir, nil
+}
+
+// file returns the resolved path and information of the named regular file
+func (l *Local) file(op, name string) (string, fs.FileInfo, error) {
+	path, err := l.path(op, name)
+	if err != nil {
+		return "", nil, err
+	}
+	resolved, inRoot, err := l.resolve(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !inRoot) {
+		return "", nil, notExist(op, name)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	fileInfo, err := os.Stat(resolved)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil, notExist(op, name)
+		}
+		return "", nil, err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return "", nil, notExist(op, name)
+	}
+	return resolved, fileInfo, nil
+}
+
+// Stat returns information about the named file
+func (l *Local) Stat(ctx context.Context, name string) (FileInfo, error) {
+	_, fileInfo, err := l.file("stat", name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+// List returns every regular file below the root directory
+func (l *Local) List(ctx context.Context) ([]FileInfo, error) {
+	var files []FileInfo
+	tempDir := filepath.Join(l.root, localTempDir)
+	err := filepath.WalkDir(l.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && path == tempDir {
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: filepath.ToSlash(rel), Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Open opens the named file for reading from its first byte
+func (l *Local) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return l.ReadRange(ctx, name, 0, -1)
+}
+
+// ReadRange returns a reader over a byte range of the named file
+func (l *Local) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if err := validRange(name, offset); err != nil {
+		return nil, err
+	}
+	path, _, err := l.file("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, notExist("open", name)
+		}
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// Put writes the file to the temporary directory and renames it into place
+func (l *Local) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	path, err := l.path("put", name)
+	if err != nil {
+		return err
+	}
+	tempDir := filepath.Join(l.root, localTempDir)
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return err
+	}
+	dir, err := l.putDir(name, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(tempDir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once the rename succeeded
+
+	written, err := io.Copy(tmp, io.LimitReader(r, size))
+	if err == nil && written != size {
+		err = shortWrite(name, size, written)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, filepath.Base(path)))
+}
+
+// putDir resolves the symlinks of dir, the directory the named file is put
+// in, as far as it exists. It fails if that leads outside the root directory.
+func (l *Local) putDir(name, dir string) (string, error) {
+	existing := dir
+	for {
+		if _, err := os.Lstat(existing); err == nil || existing == filepath.Dir(existing) {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, inRoot, err := l.resolve(existing)
+	if err != nil {
+		return "", err
+	}
+	if !inRoot {
+		return "", &fs.PathError{Op: "put", Path: name, Err: fs.ErrPermission}
+	}
+	missing, err := filepath.Rel(existing, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, missing), nil
+}
+
+// limitedReadCloser closes the underlying file of a length-limited reader
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package store
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Whence values of lseek that find data and holes in sparse files
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// Holes returns the holes of the named file that overlap [start, end), found
+// with SEEK_HOLE and SEEK_DATA. Filesystems without hole support report none.
+func (l *Local) Holes(ctx context.Context, name string, start, end int64) ([][2]int64, error) {
+	path, err := l.path("holes", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, notExist("holes", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var holes [][2]int64
+	for offset := start; offset < end; {
+		hole, err := file.Seek(offset, seekHole)
+		if errors.Is(err, syscall.ENXIO) || errors.Is(err, syscall.EINVAL) {
+			break // offset is at the end of the file, or holes are not supported
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hole >= end {
+			break
+		}
+		data, err := file.Seek(hole, seekData)
+		if errors.Is(err, syscall.ENXIO) || data > end {
+			data = end // The hole runs to the end of the file
+		} else if err != nil {
+			return nil, err
+		}
+		holes = append(holes, [2]int64{hole, data})
+		offset = data
+	}
+	return holes, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package store
+
+import "context"
+
+// Holes reports no holes. Finding them is only implemented on Linux.
+func (l *Local) Holes(ctx context.Context, name string, start, end int64) ([][2]int64, error) {
+	return nil, nil
+}
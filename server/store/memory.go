@@ -0,0 +1,111 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a store that keeps its files in memory. It is meant for tests.
+type Memory struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory returns an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]memoryFile)}
+}
+
+// Add stores data under name, replacing any previous content
+func (m *Memory) Add(name string, data []byte) error {
+	if err := validName("add", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = memoryFile{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) lookup(op, name string) (memoryFile, error) {
+	if err := validName(op, name); err != nil {
+		return memoryFile{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	file, ok := m.files[name]
+	if !ok {
+		return memoryFile{}, notExist(op, name)
+	}
+	return file, nil
+}
+
+// Stat returns information about the named file
+func (m *Memory) Stat(ctx context.Context, name string) (FileInfo, error) {
+	file, err := m.lookup("stat", name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: int64(len(file.data)), ModTime: file.modTime}, nil
+}
+
+// List returns every file in the store
+func (m *Memory) List(ctx context.Context) ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	files := make([]FileInfo, 0, len(m.files))
+	for name, file := range m.files {
+		files = append(files, FileInfo{Name: name, Size: int64(len(file.data)), ModTime: file.modTime})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Open opens the named file for reading from its first byte
+func (m *Memory) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return m.ReadRange(ctx, name, 0, -1)
+}
+
+// ReadRange returns a reader over a byte range of the named file
+func (m *Memory) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if err := validRange(name, offset); err != nil {
+		return nil, err
+	}
+	file, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(file.data))
+	if offset > size {
+		offset = size
+	}
+	end := size
+	if length >= 0 && length < size-offset {
+		end = offset + length
+	}
+	return io.NopCloser(bytes.NewReader(file.data[offset:end])), nil
+}
+
+// Put reads the whole file into memory and stores it under name
+func (m *Memory) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := validName("put", name); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return shortWrite(name, size, int64(len(data)))
+	}
+	return m.Add(name, data)
+}
@@ -0,0 +1,394 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// emptyPayloadHash is the SHA-256 of an empty request body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// unsignedPayload tells S3 that a streamed request body is not part of the signature
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Config describes how to reach an S3-compatible bucket
+type S3Config struct {
+	Endpoint  string       // Base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	Region    string       // Region used for request signing
+	Bucket    string       // Bucket holding the files
+	Prefix    string       // Optional key prefix the store is rooted at
+	AccessKey string       // Access key ID, requests are sent unsigned when empty
+	SecretKey string       // Secret access key
+	Client    *http.Client // HTTP client to use, http.DefaultClient when nil
+}
+
+// S3 serves files from an S3-compatible object store. Objects are addressed
+// path-style ({endpoint}/{bucket}/{key}), which works with AWS as well as
+// self-hosted implementations such as MinIO.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	now      func() time.Time
+}
+
+// NewS3 returns a store backed by the bucket described by cfg
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: bucket is required")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint: %w", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: endpoint %q must be an absolute URL", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &S3{cfg: cfg, endpoint: endpoint, now: time.Now}, nil
+}
+
+// key maps a store name onto an object key
+func (s *S3) key(name string) string {
+	if s.cfg.Prefix == "" {
+		return name
+	}
+	return s.cfg.Prefix + "/" + name
+}
+
+// newRequest builds a signed request without a body against the bucket
+func (s *S3) newRequest(ctx context.Context, method, key string, query url.Values, header http.Header) (*http.Request, error) {
+	return s.newBodyRequest(ctx, method, key, query, header, nil, 0)
+}
+
+// newBodyRequest builds a signed request against the bucket. The body, if
+// any, is sent as an unsigned payload so it can be streamed.
+func (s *S3) newBodyRequest(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Request, error) {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + "/" + s.cfg.Bucket
+	u.RawPath = base + "/" + awsEscape(s.cfg.Bucket)
+	if key != "" {
+		u.Path += "/" + key
+		segments := strings.Split(key, "/")
+		for i, segment := range segments {
+			segments[i] = awsEscape(segment)
+		}
+		u.RawPath += "/" + strings.Join(segments, "/")
+	}
+	u.RawQuery = query.Encode()
+
+	if body != nil && size == 0 {
+		// net/http takes a zero ContentLength with a body for an unknown
+		// length and would send it chunked, which S3 rejects
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = unsignedPayload
+	}
+	s.sign(req, payloadHash)
+	return req, nil
+}
+
+// do sends a request and converts S3 error responses into Go errors
+func (s *S3) do(req *http.Request, op, name string) (*http.Response, error) {
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, notExist(op, name)
+	case resp.StatusCode >= 300 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", op, name, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// Stat returns information about the named object
+func (s *S3) Stat(ctx context.Context, name string) (FileInfo, error) {
+	if err := validName("stat", name); err != nil {
+		return FileInfo{}, err
+	}
+	req, err := s.newRequest(ctx, http.MethodHead, s.key(name), nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp, err := s.do(req, "stat", name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// listBucketResult is the subset of a ListObjectsV2 response the store needs
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns every object below the configured prefix
+func (s *S3) List(ctx context.Context) ([]FileInfo, error) {
+	prefix := ""
+	if s.cfg.Prefix != "" {
+		prefix = s.cfg.Prefix + "/"
+	}
+
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, "list", s.cfg.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: decoding list response: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			if validName("list", name) != nil {
+				continue // Directory markers and keys that cannot be addressed
+			}
+			files = append(files, FileInfo{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Open opens the named object for reading from its first byte
+func (s *S3) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.ReadRange(ctx, name, 0, -1)
+}
+
+// ReadRange fetches a byte range of the named object with a ranged GET
+func (s *S3) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if err := validName("open", name); err != nil {
+		return nil, err
+	}
+	if err := validRange(name, offset); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	header := http.Header{}
+	switch {
+	case length > 0 && length <= math.MaxInt64-offset: // A longer range reaches the end
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, s.key(name), nil, header)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, "open", name)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The range starts at or past the end of the object
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if header.Get("Range") != "" && resp.StatusCode == http.StatusOK {
+		// The server ignored the range and sent the whole object
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if length > 0 {
+			return &limitedReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+		}
+	}
+	return resp.Body, nil
+}
+
+// Put uploads the object with a single PUT request
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := validName("put", name); err != nil {
+		return err
+	}
+	counter := &countingReader{r: io.LimitReader(r, size)}
+	req, err := s.newBodyRequest(ctx, http.MethodPut, s.key(name), nil, nil, counter, size)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, "put", name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if counter.n != size {
+		return shortWrite(name, size, counter.n)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	if s.cfg.AccessKey == "" {
+		return
+	}
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers: host plus every header we set, lower-cased and sorted
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+// canonicalQuery encodes query parameters the way SigV4 expects
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything except the RFC 3986 unreserved characters
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,81 @@
+// Package store defines the storage backends the file service reads from.
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// FileInfo describes a single file held by a Store
+type FileInfo struct {
+	Name    string    // Slash-separated path of the file inside the store
+	Size    int64     // Size of the file in bytes
+	ModTime time.Time // Last modification time, zero if the backend does not track it
+}
+
+// Store is a source of files that can be served to clients.
+//
+// Names are slash-separated relative paths as accepted by fs.ValidPath.
+// Errors for unknown names wrap fs.ErrNotExist and errors for malformed
+// names wrap fs.ErrInvalid, so callers can classify them with errors.Is.
+type Store interface {
+	// Stat returns information about the named file
+	Stat(ctx context.Context, name string) (FileInfo, error)
+	// List returns every file in the store, sorted by name
+	List(ctx context.Context) ([]FileInfo, error)
+	// Open opens the named file for reading from its first byte
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// ReadRange returns a reader over length bytes of the named file starting
+	// at offset. A negative length reads until the end of the file.
+	ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// Put stores size bytes read from r under name, replacing any existing
+	// file. Readers never observe a partially written file.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+}
+
+// HoleFinder is implemented by stores that know where a file has holes:
+// ranges with no data allocated that read as zeros. Stores that cannot tell
+// report no holes.
+type HoleFinder interface {
+	// Holes returns the holes of the named file that overlap [start, end),
+	// clipped to it and in ascending order
+	Holes(ctx context.Context, name string, start, end int64) ([][2]int64, error)
+}
+
+// Holes returns the holes of the named file in s that overlap [start, end),
+// or none if s is not a HoleFinder
+func Holes(ctx context.Context, s Store, name string, start, end int64) ([][2]int64, error) {
+	if finder, ok := s.(HoleFinder); ok {
+		return finder.Holes(ctx, name, start, end)
+	}
+	return nil, nil
+}
+
+// validName rejects names that are not clean relative paths inside the store
+func validName(op, name string) error {
+	if name == "" || name == "." || !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// notExist returns the error reported for a missing file
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// validRange rejects ranges that start before the beginning of a file
+func validRange(name string, offset int64) error {
+	if offset < 0 {
+		return &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("%w: negative offset %d", fs.ErrInvalid, offset)}
+	}
+	return nil
+}
+
+// shortWrite is returned by Put when r ends before size bytes were read
+func shortWrite(name string, want, got int64) error {
+	return fmt.Errorf("put %s: read %d of %d bytes: %w", name, got, want, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/4erneff/alcatraz/synthetic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStore exercises the behaviour every Store implementation must share. The
+// store must contain "a.bin" holding "0123456789" and "dir/b.bin" holding "xyz".
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	files, err := s.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, "a.bin", files[0].Name)
+	assert.Equal(t, int64(10), files[0].Size)
+	assert.Equal(t, "dir/b.bin", files[1].Name)
+
+	info, err := s.Stat(ctx, "dir/b.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), info.Size)
+
+	_, err = s.Stat(ctx, "missing.bin")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "Missing file should wrap fs.ErrNotExist")
+	_, err = s.Stat(ctx, "dir")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "Directories are not files")
+	for _, name := range []string{"", ".", "../a.bin", "/a.bin"} {
+		_, err = s.Stat(ctx, name)
+		assert.True(t, errors.Is(err, fs.ErrInvalid), "Name %q should be rejected", name)
+	}
+
+	read := func(offset, length int64) string {
+		r, err := s.ReadRange(ctx, "a.bin", offset, length)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, "2345", read(2, 4))
+	assert.Equal(t, "789", read(7, -1))
+	assert.Equal(t, "89", read(8, 100))
+	assert.Equal(t, "89", read(8, math.MaxInt64), "A length reaching past the largest offset should not overflow")
+	assert.Equal(t, "", read(10, -1))
+
+	r, err := s.Open(ctx, "a.bin")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "0123456789", string(data))
+
+	_, err = s.ReadRange(ctx, "a.bin", -1, 1)
+	assert.True(t, errors.Is(err, fs.ErrInvalid), "Negative offsets should be rejected")
+
+	require.NoError(t, s.Put(ctx, "new/c.bin", strings.NewReader("hello"), 5))
+	info, err = s.Stat(ctx, "new/c.bin")
+	require.NoError(t, err, "Stored file should be visible")
+	assert.Equal(t, int64(5), info.Size)
+
+	err = s.Put(ctx, "new/d.bin", strings.NewReader("hi"), 5)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "Short input should be reported")
+	_, err = s.Stat(ctx, "new/d.bin")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "A failed put must not leave a file behind")
+}
+
+func TestLocal(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.bin"), []byte("0123456789"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "dir", "b.bin"), []byte("xyz"), 0644))
+
+	testStore(t, NewLocal(root))
+}
+
+// listingReader lists a store on its first read, while a Put of it is in progress
+type listingReader struct {
+	io.Reader
+	store Store
+	files []FileInfo
+}
+
+func (r *listingReader) Read(p []byte) (int, error) {
+	if r.files == nil {
+		files, err := r.store.List(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		r.files = files
+	}
+	return r.Reader.Read(p)
+}
+
+func TestLocal_PutHidesTempFile(t *testing.T) {
+	s := NewLocal(filepath.Join(t.TempDir(), "root"))
+	r := &listingReader{Reader: strings.NewReader("hello"), store: s}
+	require.NoError(t, s.Put(context.Background(), "c.bin", r, 5), "Put should create the root directory")
+	assert.Empty(t, r.files, "The file being put should not be listed")
+
+	files, err := s.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "c.bin", files[0].Name)
+	_, err = s.Stat(context.Background(), localTempDir+"/c.bin")
+	assert.True(t, errors.Is(err, fs.ErrInvalid), "The temporary directory should not be part of the store")
+}
+
+func TestLocal_Symlinks(t *testing.T) {
+	ctx := context.Background()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600))
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.bin"), []byte("0123456789"), 0644))
+	require.NoError(t, os.Symlink("a.bin", filepath.Join(root, "inside.bin")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "out")))
+	s := NewLocal(root)
+
+	info, err := s.Stat(ctx, "inside.bin")
+	require.NoError(t, err, "Symlinks within the root should be followed")
+	assert.Equal(t, int64(10), info.Size)
+
+	for _, name := range []string{"secret.txt", "out/secret.txt"} {
+		_, err = s.Stat(ctx, name)
+		assert.True(t, errors.Is(err, fs.ErrNotExist), "%s leads outside the root", name)
+		_, err = s.Open(ctx, name)
+		assert.True(t, errors.Is(err, fs.ErrNotExist), "%s leads outside the root", name)
+	}
+
+	err = s.Put(ctx, "out/new/c.bin", strings.NewReader("hello"), 5)
+	assert.True(t, errors.Is(err, fs.ErrPermission), "Put should not follow symlinks outside the root")
+	_, err = os.Stat(filepath.Join(outside, "new"))
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "Put should not create directories outside the root")
+}
+
+func TestMemory(t *testing.T) {
+	s := NewMemory()
+	require.NoError(t, s.Add("a.bin", []byte("0123456789")))
+	require.NoError(t, s.Add("dir/b.bin", []byte("xyz")))
+
+	testStore(t, s)
+}
+
+func TestGenerated(t *testing.T) {
+	base := NewMemory()
+	require.NoError(t, base.Add("a.bin", []byte("0123456789")))
+	gen, err := synthetic.NewGenerator(synthetic.PatternZeros, 3, 0)
+	require.NoError(t, err)
+	s, err := NewGenerated(base, "dir/b.bin", gen)
+	require.NoError(t, err)
+
+	testStore(t, s)
+
+	ctx := context.Background()
+	err = s.Put(ctx, "dir/b.bin", strings.NewReader("x"), 1)
+	assert.True(t, errors.Is(err, fs.ErrPermission), "The generated file cannot be replaced")
+	_, err = base.Stat(ctx, "dir/b.bin")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "The generated file should not be stored")
+
+	gen, err = synthetic.NewGenerator(synthetic.PatternRandom, 1000, 1)
+	require.NoError(t, err)
+	s, err = NewGenerated(base, "c.bin", gen)
+	require.NoError(t, err)
+	r, err := s.Open(ctx, "c.bin")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Len(t, data, 1000)
+
+	r, err = s.ReadRange(ctx, "c.bin", 123, 300)
+	require.NoError(t, err)
+	part, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data[123:423], part, "Ranges should match the whole file")
+}
+
+func TestSynthetic(t *testing.T) {
+	base := NewMemory()
+	require.NoError(t, base.Add("a.bin", []byte("0123456789")))
+	require.NoError(t, base.Add("dir/b.bin", []byte("xyz")))
+	s := NewSynthetic(base)
+
+	testStore(t, s)
+
+	ctx := context.Background()
+	info, err := s.Stat(ctx, "synthetic/1KiB?seed=42")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), info.Size)
+
+	r, err := s.ReadRange(ctx, "synthetic/1KiB?seed=42", 1000, 100)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	gen, err := synthetic.Parse("synthetic/1KiB?seed=42")
+	require.NoError(t, err)
+	expected := make([]byte, 24)
+	_, err = gen.ReadAt(expected, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data, "Served bytes should match the generator")
+
+	_, err = s.Stat(ctx, "synthetic/lots")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "Malformed synthetic names should not exist")
+	err = s.Put(ctx, "synthetic/1KiB", strings.NewReader("x"), 1)
+	assert.True(t, errors.Is(err, fs.ErrPermission), "Synthetic files cannot be written")
+}
+
+func TestLocal_Holes(t *testing.T) {
+	root := t.TempDir()
+	file, err := os.Create(filepath.Join(root, "disk.img"))
+	require.NoError(t, err)
+	require.NoError(t, file.Truncate(3<<20))
+	_, err = file.WriteAt(make([]byte, 4096), 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	s := NewLocal(root)
+	holes, err := s.Holes(context.Background(), "disk.img", 0, 3<<20)
+	require.NoError(t, err)
+	if len(holes) == 0 {
+		t.Skip("the filesystem does not report holes")
+	}
+	assert.Equal(t, [][2]int64{{0, 1 << 20}, {1<<20 + 4096, 3 << 20}}, holes)
+
+	holes, err = s.Holes(context.Background(), "disk.img", 512, 1<<20+8192)
+	require.NoError(t, err)
+	assert.Equal(t, [][2]int64{{512, 1 << 20}, {1<<20 + 4096, 1<<20 + 8192}}, holes, "Holes should be clipped to the range")
+
+	_, err = s.Holes(context.Background(), "missing.img", 0, 1)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
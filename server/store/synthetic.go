@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"io"
+	"io/fs"
+
+	"github.com/4erneff/alcatraz/synthetic"
+)
+
+// Synthetic serves every name below synthetic.Prefix, such as
+// "synthetic/10GiB?seed=42", from a generator computing its bytes on the
+// fly. Every other name is passed through to the base store. Synthetic files
+// are not listed, as there is one for every size and seed.
+type Synthetic struct {
+	base Store
+}
+
+// NewSynthetic returns base with synthetic files served next to its own
+func NewSynthetic(base Store) *Synthetic {
+	return &Synthetic{base: base}
+}
+
+// generator returns the generator of a synthetic file name
+func (s *Synthetic) generator(op, name string) (*synthetic.Generator, error) {
+	if err := validName(op, name); err != nil {
+		return nil, err
+	}
+	gen, err := synthetic.Parse(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return gen, nil
+}
+
+// Stat returns information about the named file
+func (s *Synthetic) Stat(ctx context.Context, name string) (FileInfo, error) {
+	if !synthetic.IsName(name) {
+		return s.base.Stat(ctx, name)
+	}
+	gen, err := s.generator("stat", name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: gen.Size()}, nil
+}
+
+// List returns the files of the base store
+func (s *Synthetic) List(ctx context.Context) ([]FileInfo, error) {
+	return s.base.List(ctx)
+}
+
+// Open opens the named file for reading
+func (s *Synthetic) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.ReadRange(ctx, name, 0, -1)
+}
+
+// ReadRange returns a reader over a byte range of the named file
+func (s *Synthetic) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if !synthetic.IsName(name) {
+		return s.base.ReadRange(ctx, name, offset, length)
+	}
+	gen, err := s.generator("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return generatedRange(gen, name, offset, length)
+}
+
+// Put stores a file in the base store. Synthetic names cannot be written.
+func (s *Synthetic) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if synthetic.IsName(name) {
+		return &fs.PathError{Op: "put", Path: name, Err: fs.ErrPermission}
+	}
+	return s.base.Put(ctx, name, r, size)
+}
+
+// Holes returns the holes of a file of the base store. Synthetic files have none.
+func (s *Synthetic) Holes(ctx context.Context, name string, start, end int64) ([][2]int64, error) {
+	if synthetic.IsName(name) {
+		return nil, nil
+	}
+	return Holes(ctx, s.base, name, start, end)
+}
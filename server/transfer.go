@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/server/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// transferSessionTTL is how long an idle transfer can be reconnected to
+const transferSessionTTL = 10 * time.Minute
+
+// transferManager tracks the flow-controlled transfers of a server, so a
+// client that reconnects is sent the chunks it had not acknowledged. The
+// zero value is ready to use.
+type transferManager struct {
+	mu       sync.Mutex
+	sessions map[string]*transferSession
+}
+
+// transferSession is the state of a single transfer across reconnects
+type transferSession struct {
+	id        string
+	info      store.FileInfo // Identity of the file when the transfer started
+	chunkSize int32
+
+	mu       sync.Mutex
+	pending  []int32        // Chunks still to send, ascending
+	unacked  map[int32]bool // Chunks sent but not yet acknowledged
+	active   bool           // Whether a stream is attached
+	lastUsed time.Time
+}
+
+// transferConn is the flow control state of one stream attached to a session
+type transferConn struct {
+	mu         sync.Mutex
+	credit     int32 // Chunks the server may still send
+	clientDone bool  // The client closed its side of the stream
+	recvErr    error
+
+	wake chan struct{} // Signalled whenever credit, acks or the stream state change
+}
+
+func (c *transferConn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// attach returns the session a transfer start asks for and marks it active.
+// A known transfer ID reconnects to its session and queues the unacknowledged
+// chunks again, along with any chunks the start asks for; otherwise a new
+// session is opened for the requested chunks.
+func (m *transferManager) attach(info store.FileInfo, start *pb.TransferStart, chunkSize int32) (*transferSession, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions == nil {
+		m.sessions = make(map[string]*transferSession)
+	}
+	m.expire(time.Now())
+
+	if session, ok := m.sessions[start.TransferId]; ok {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		if session.active {
+			return nil, false, status.Errorf(codes.FailedPrecondition, "transfer %s is already in progress", session.id)
+		}
+		if session.info.Name != start.FileId {
+			return nil, false, status.Errorf(codes.InvalidArgument, "transfer %s is of %s, not %s", session.id, session.info.Name, start.FileId)
+		}
+		if session.info.Size != info.Size || !session.info.ModTime.Equal(info.ModTime) {
+			delete(m.sessions, session.id)
+			return nil, false, status.Errorf(codes.FailedPrecondition, "%s changed since transfer %s started", start.FileId, session.id)
+		}
+		if len(start.Ranges) > 0 {
+			// The client knows best which chunks it is missing
+			requested, err := transferChunks(info.Size, start.Ranges, session.chunkSize)
+			if err != nil {
+				return nil, false, err
+			}
+			session.pending = append(session.pending, requested...)
+		}
+		for seq := range session.unacked {
+			session.pending = append(session.pending, seq)
+		}
+		sort.Slice(session.pending, func(i, j int) bool { return session.pending[i] < session.pending[j] })
+		session.pending = dedupe(session.pending)
+		session.unacked = make(map[int32]bool)
+		session.active = true
+		session.lastUsed = time.Now()
+		return session, true, nil
+	}
+
+	pending, err := transferChunks(info.Size, start.Ranges, chunkSize)
+	if err != nil {
+		return nil, false, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, false, err
+	}
+	session := &transferSession{
+		id:        hex.EncodeToString(id),
+		info:      info,
+		chunkSize: chunkSize,
+		pending:   pending,
+		unacked:   make(map[int32]bool),
+		active:    true,
+		lastUsed:  time.Now(),
+	}
+	m.sessions[session.id] = session
+	return session, false, nil
+}
+
+// transferChunks returns the ascending sequence numbers of the chunks in
+// chunkRanges, or of every chunk of the file if chunkRanges is empty
+func transferChunks(totalSize int64, chunkRanges []*pb.ChunkRange, chunkSize int32) ([]int32, error) {
+	ranges, err := requestedChunkRanges(&pb.FileRequest{Ranges: chunkRanges}, totalSize, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunkRanges) == 0 {
+		ranges = [][2]int64{{0, totalSize}}
+	}
+
+	var seqs []int32
+	for _, r := range ranges {
+		for seq := int32(r[0] / int64(chunkSize)); int64(seq)*int64(chunkSize) < r[1]; seq++ {
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs, nil
+}
+
+// dedupe removes repeated values from a sorted slice
+func dedupe(seqs []int32) []int32 {
+	out := seqs[:0]
+	for i, seq := range seqs {
+		if i == 0 || seq != seqs[i-1] {
+			out = append(out, seq)
+		}
+	}
+	return out
+}
+
+// expire drops idle sessions nobody reconnected to. The caller must hold m.mu.
+func (m *transferManager) expire(now time.Time) {
+	for id, session := range m.sessions {
+		session.mu.Lock()
+		idle := !session.active && now.Sub(session.lastUsed) > transferSessionTTL
+		session.mu.Unlock()
+		if idle {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// detach marks a session idle, or forgets it once every chunk was
+// acknowledged. It also drops the sessions that expired meanwhile, so a
+// server nobody starts new transfers on does not keep them.
+func (m *transferManager) detach(session *transferSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.active = false
+	session.lastUsed = time.Now()
+	if len(session.pending) == 0 && len(session.unacked) == 0 {
+		delete(m.sessions, session.id)
+	}
+}
+
+// Transfer streams a file under the client's flow control. The server only
+// sends chunks the client has granted credit for, and ends the stream once
+// every chunk has been acknowledged or the client closes its side.
+func (s *server) Transfer(stream pb.FileService_TransferServer) error {
+	ctx := stream.Context()
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := req.Start
+	if start == nil {
+		return status.Error(codes.InvalidArgument, "the first message of a transfer must start it")
+	}
+	if start.Window < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid window %d", start.Window)
+	}
+
+	info, err := s.store.Stat(ctx, start.FileId)
+	if err != nil {
+		return storeError(start.FileId, err)
+	}
+	session, resumed, err := s.transfers.attach(info, start, s.negotiateChunkSize(start.ChunkSize))
+	if err != nil {
+		return err
+	}
+	defer s.transfers.detach(session)
+
+	if err := stream.Send(&pb.TransferResponse{Session: &pb.TransferSession{
+		TransferId:  session.id,
+		TotalSize:   info.Size,
+		TotalChunks: chunkCount(info.Size, session.chunkSize),
+		ChunkSize:   session.chunkSize,
+		Resumed:     resumed,
+	}}); err != nil {
+		return err
+	}
+
+	opts := s.sendOptions(start.Sparse, start.Codecs)
+	conn := &transferConn{credit: start.Window, wake: make(chan struct{}, 1)}
+	go receiveTransferControl(stream, session, conn)
+
+	for {
+		seq, ok, err := nextTransferChunk(ctx, session, conn)
+		if err != nil || !ok {
+			return err
+		}
+		offset := int64(seq) * int64(session.chunkSize)
+		end := offset + int64(session.chunkSize)
+		if end > info.Size {
+			end = info.Size
+		}
+		err = s.sendRange(ctx, start.FileId, offset, end, info.Size, session.chunkSize, opts, func(chunk *pb.FileChunk) error {
+			return stream.Send(&pb.TransferResponse{Chunk: chunk})
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receiveTransferControl applies the credit and acknowledgements the client
+// sends until its side of the stream ends
+func receiveTransferControl(stream pb.FileService_TransferServer, session *transferSession, conn *transferConn) {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			conn.mu.Lock()
+			conn.clientDone = true
+			if err != io.EOF {
+				conn.recvErr = err
+			}
+			conn.mu.Unlock()
+			conn.signal()
+			return
+		}
+
+		session.mu.Lock()
+		for _, seq := range req.Acks {
+			delete(session.unacked, seq)
+		}
+		session.mu.Unlock()
+
+		conn.mu.Lock()
+		if req.Credit < 0 {
+			conn.recvErr = status.Errorf(codes.InvalidArgument, "invalid credit %d", req.Credit)
+			conn.clientDone = true
+		} else {
+			conn.credit += req.Credit
+		}
+		conn.mu.Unlock()
+		conn.signal()
+	}
+}
+
+// nextTransferChunk waits until the client has granted credit and returns
+// the next chunk to send. It reports false once the transfer is over: every
+// chunk was acknowledged or the client closed its side of the stream.
+func nextTransferChunk(ctx context.Context, session *transferSession, conn *transferConn) (int32, bool, error) {
+	for {
+		conn.mu.Lock()
+		clientDone, recvErr, credit := conn.clientDone, conn.recvErr, conn.credit
+		conn.mu.Unlock()
+		if recvErr != nil {
+			return 0, false, recvErr
+		}
+		if clientDone {
+			return 0, false, nil
+		}
+
+		session.mu.Lock()
+		if len(session.pending) == 0 && len(session.unacked) == 0 {
+			session.mu.Unlock()
+			return 0, false, nil
+		}
+		if credit > 0 && len(session.pending) > 0 {
+			seq := session.pending[0]
+			session.pending = session.pending[1:]
+			session.unacked[seq] = true
+			session.mu.Unlock()
+
+			conn.mu.Lock()
+			conn.credit--
+			conn.mu.Unlock()
+			return seq, true, nil
+		}
+		session.mu.Unlock()
+
+		select {
+		case <-conn.wake:
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/server/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const transferChunk = 64 * 1024
+
+func newTransferServer(t *testing.T, chunks int) (*server, []byte) {
+	data := make([]byte, chunks*transferChunk-10)
+	for i := range data {
+		data[i] = byte(i % 249)
+	}
+	memStore := store.NewMemory()
+	require.NoError(t, memStore.Add("data.bin", data))
+	return &server{store: memStore}, data
+}
+
+// startTransfer opens a transfer and returns its stream and session
+func startTransfer(t *testing.T, ctx context.Context, client pb.FileServiceClient, start *pb.TransferStart) (pb.FileService_TransferClient, *pb.TransferSession) {
+	stream, err := client.Transfer(ctx)
+	require.NoError(t, err)
+	start.FileId = "data.bin"
+	start.ChunkSize = transferChunk
+	require.NoError(t, stream.Send(&pb.TransferRequest{Start: start}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.NotNil(t, resp.Session, "The first message should describe the session")
+	return stream, resp.Session
+}
+
+// recvChunk receives the next chunk, failing if none arrives in time
+func recvChunk(t *testing.T, stream pb.FileService_TransferClient) *pb.FileChunk {
+	type result struct {
+		resp *pb.TransferResponse
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		resp, err := stream.Recv()
+		received <- result{resp, err}
+	}()
+	select {
+	case r := <-received:
+		require.NoError(t, r.err)
+		require.NotNil(t, r.resp.Chunk)
+		return r.resp.Chunk
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a chunk")
+		return nil
+	}
+}
+
+func TestTransfer_CreditWindow(t *testing.T) {
+	srv, data := newTransferServer(t, 4)
+	client := dialServer(t, srv)
+
+	stream, session := startTransfer(t, context.Background(), client, &pb.TransferStart{Window: 2})
+	assert.Equal(t, int32(4), session.TotalChunks)
+	assert.False(t, session.Resumed)
+
+	assert.Equal(t, int32(0), recvChunk(t, stream).SequenceNumber)
+	assert.Equal(t, int32(1), recvChunk(t, stream).SequenceNumber)
+
+	// The window is used up, nothing more arrives until credit is granted
+	next := make(chan *pb.TransferResponse, 1)
+	go func() {
+		resp, _ := stream.Recv()
+		next <- resp
+	}()
+	select {
+	case resp := <-next:
+		t.Fatalf("Server sent chunk %d without credit", resp.GetChunk().GetSequenceNumber())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, stream.Send(&pb.TransferRequest{Credit: 2, Acks: []int32{0, 1}}))
+	chunk := (<-next).Chunk
+	assert.Equal(t, int32(2), chunk.SequenceNumber)
+	assert.Equal(t, data[2*transferChunk:3*transferChunk], chunk.ChunkData)
+	last := recvChunk(t, stream)
+	assert.Equal(t, data[3*transferChunk:], last.ChunkData)
+
+	// The stream ends once every chunk has been acknowledged
+	require.NoError(t, stream.Send(&pb.TransferRequest{Acks: []int32{2, 3}}))
+	_, err := stream.Recv()
+	assert.Error(t, err)
+	assert.Empty(t, srv.transfers.sessions, "A completed transfer should be forgotten")
+}
+
+func TestTransfer_ResendUnackedAfterReconnect(t *testing.T) {
+	srv, _ := newTransferServer(t, 5)
+	client := dialServer(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, session := startTransfer(t, ctx, client, &pb.TransferStart{Window: 3, Ranges: []*pb.ChunkRange{{StartChunk: 1, EndChunk: 5}}})
+	for _, seq := range []int32{1, 2, 3} {
+		assert.Equal(t, seq, recvChunk(t, stream).SequenceNumber)
+	}
+	require.NoError(t, stream.Send(&pb.TransferRequest{Acks: []int32{1}}))
+	time.Sleep(50 * time.Millisecond) // Let the acknowledgement arrive before the connection drops
+	cancel()
+
+	// Chunks 2 and 3 were sent but never acknowledged, 4 was never sent
+	require.Eventually(t, func() bool {
+		srv.transfers.mu.Lock()
+		s := srv.transfers.sessions[session.TransferId]
+		srv.transfers.mu.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return !s.active
+	}, 5*time.Second, 10*time.Millisecond, "The session should be detached once the stream is gone")
+
+	stream, resumed := startTransfer(t, context.Background(), client, &pb.TransferStart{Window: 10, TransferId: session.TransferId})
+	assert.True(t, resumed.Resumed)
+	assert.Equal(t, session.TransferId, resumed.TransferId)
+	var seqs []int32
+	for i := 0; i < 3; i++ {
+		seqs = append(seqs, recvChunk(t, stream).SequenceNumber)
+	}
+	assert.Equal(t, []int32{2, 3, 4}, seqs)
+	require.NoError(t, stream.CloseSend())
+}
+
+func TestTransfer_ReconnectQueuesRequestedChunks(t *testing.T) {
+	srv, _ := newTransferServer(t, 4)
+	client := dialServer(t, srv)
+
+	stream, session := startTransfer(t, context.Background(), client, &pb.TransferStart{Window: 1, Ranges: []*pb.ChunkRange{{StartChunk: 0, EndChunk: 1}}})
+	assert.Equal(t, int32(0), recvChunk(t, stream).SequenceNumber)
+	require.NoError(t, stream.CloseSend())
+	_, err := stream.Recv()
+	require.Error(t, err)
+
+	// Chunk 0 was never acknowledged, chunk 2 is asked for on reconnect
+	stream, resumed := startTransfer(t, context.Background(), client, &pb.TransferStart{Window: 10, TransferId: session.TransferId, Ranges: []*pb.ChunkRange{{StartChunk: 2, EndChunk: 3}}})
+	assert.True(t, resumed.Resumed)
+	assert.Equal(t, int32(0), recvChunk(t, stream).SequenceNumber)
+	assert.Equal(t, int32(2), recvChunk(t, stream).SequenceNumber)
+	require.NoError(t, stream.Send(&pb.TransferRequest{Acks: []int32{0, 2}}))
+	_, err = stream.Recv()
+	assert.Error(t, err, "The stream should end once every chunk has been acknowledged")
+}
+
+func TestTransfer_FileChangedBeforeReconnect(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	require.NoError(t, os.WriteFile(path, make([]byte, 3*transferChunk), 0644))
+	srv := &server{store: store.NewLocal(dir)}
+	client := dialServer(t, srv)
+
+	stream, session := startTransfer(t, context.Background(), client, &pb.TransferStart{Window: 1})
+	recvChunk(t, stream)
+	require.NoError(t, stream.CloseSend())
+	_, err := stream.Recv()
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, make([]byte, 2*transferChunk), 0644))
+	stream, err = client.Transfer(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.TransferRequest{Start: &pb.TransferStart{FileId: "data.bin", ChunkSize: transferChunk, Window: 1, TransferId: session.TransferId}}))
+	_, err = stream.Recv()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestTransfer_InvalidStart(t *testing.T) {
+	srv, _ := newTransferServer(t, 2)
+	client := dialServer(t, srv)
+
+	stream, err := client.Transfer(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.TransferRequest{Credit: 1}))
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "A transfer must start with a start message")
+
+	stream, err = client.Transfer(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.TransferRequest{Start: &pb.TransferStart{FileId: "missing.bin", Window: 1}}))
+	_, err = stream.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestTransfer_DetachExpiresIdleSessions(t *testing.T) {
+	var m transferManager
+	info := store.FileInfo{Name: "data.bin", Size: 2 * transferChunk}
+	stale, _, err := m.attach(info, &pb.TransferStart{FileId: "data.bin"}, transferChunk)
+	require.NoError(t, err)
+	active, _, err := m.attach(info, &pb.TransferStart{FileId: "data.bin"}, transferChunk)
+	require.NoError(t, err)
+	m.detach(stale)
+	stale.lastUsed = time.Now().Add(-2 * transferSessionTTL)
+
+	// A stream ending without every chunk acknowledged keeps its own session
+	m.detach(active)
+	assert.NotContains(t, m.sessions, stale.id, "An expired session should be dropped when another stream ends")
+	assert.Contains(t, m.sessions, active.id)
+}
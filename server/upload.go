@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/server/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// uploadSessionTTL is how long an idle upload can be resumed. Expired
+// sessions are dropped along with their staging file.
+const uploadSessionTTL = time.Hour
+
+// uploadManager tracks the upload sessions of a server. Chunks are staged in
+// a local file per session and the file is handed to the store once every
+// chunk has been received and verified.
+type uploadManager struct {
+	dir   string      // Staging directory for partially uploaded files
+	store store.Store // Destination of completed uploads
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+// uploadSession is the state of a single upload
+type uploadSession struct {
+	mu          sync.Mutex
+	id          string
+	fileID      string
+	totalSize   int64
+	checksum    string // SHA-256 of the whole file, hex encoded
+	totalChunks int32
+	staging     *os.File
+	received    []bool
+	complete    bool
+	committing  chan struct{} // Closed once the running commit ends, nil while none runs
+	dropped     bool          // The session expired or failed, its staging file is gone
+	streams     int           // Number of UploadFile streams writing to the session
+	lastUsed    time.Time     // Last time a client touched the session
+}
+
+// newUploadManager returns a manager staging uploads in dir
+func newUploadManager(dir string, fileStore store.Store) (*uploadManager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &uploadManager{dir: dir, store: fileStore, sessions: make(map[string]*uploadSession)}, nil
+}
+
+// start opens a new session, or returns the unfinished session of the same
+// file, size and checksum so an interrupted client can resume it. A different
+// file of the same size never joins the chunks of another.
+func (m *uploadManager) start(ctx context.Context, fileID string, totalSize int64, checksum string) (*uploadSession, error) {
+	if fileID == "" || fileID == "." || !fs.ValidPath(fileID) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid file id %q", fileID)
+	}
+	if totalSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid total size %d", totalSize)
+	}
+	if sum, err := hex.DecodeString(checksum); err != nil || len(sum) != sha256.Size {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid checksum %q, expected a hex encoded SHA-256", checksum)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.expire(now)
+	for _, session := range m.sessions {
+		session.mu.Lock()
+		resumable := session.fileID == fileID && session.totalSize == totalSize && session.checksum == checksum && !session.complete
+		if resumable {
+			session.lastUsed = now
+		}
+		session.mu.Unlock()
+		if resumable {
+			return session, nil
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	session := &uploadSession{
+		id:          hex.EncodeToString(id),
+		fileID:      fileID,
+		totalSize:   totalSize,
+		checksum:    checksum,
+		totalChunks: chunkCount(totalSize, fileChunkSize),
+		lastUsed:    now,
+	}
+	session.received = make([]bool, session.totalChunks)
+
+	staging, err := os.Create(filepath.Join(m.dir, session.id+".partial"))
+	if err != nil {
+		return nil, err
+	}
+	if err := staging.Truncate(totalSize); err != nil {
+		staging.Close()
+		os.Remove(staging.Name())
+		return nil, err
+	}
+	session.staging = staging
+	m.sessions[session.id] = session
+
+	if session.totalChunks == 0 {
+		// Nothing to wait for, an empty file is stored right away. The
+		// manager is locked, so it is not handed to commit.
+		if _, err := session.commit(ctx, m.store); err != nil {
+			delete(m.sessions, session.id)
+			session.mu.Lock()
+			session.discard()
+			session.mu.Unlock()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// lookup returns the session with the given ID
+func (m *uploadManager) lookup(id string) (*uploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.expire(now)
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "upload %q not found", id)
+	}
+	session.mu.Lock()
+	session.lastUsed = now
+	session.mu.Unlock()
+	return session, nil
+}
+
+// commit stores the staged file once all of its chunks have been received.
+// A file that does not match its checksum is dropped, as no chunk can be
+// told apart as the bad one.
+func (m *uploadManager) commit(ctx context.Context, session *uploadSession) error {
+	mismatch, err := session.commit(ctx, m.store)
+	if mismatch {
+		m.drop(session)
+	}
+	return err
+}
+
+// drop forgets a session and removes its staging file
+func (m *uploadManager) drop(session *uploadSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, session.id)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.discard()
+}
+
+// expire drops sessions no client has touched within uploadSessionTTL,
+// finished or not. The caller must hold m.mu.
+func (m *uploadManager) expire(now time.Time) {
+	for id, session := range m.sessions {
+		session.mu.Lock()
+		if session.streams == 0 && session.committing == nil && now.Sub(session.lastUsed) > uploadSessionTTL {
+			delete(m.sessions, id)
+			session.discard()
+		}
+		session.mu.Unlock()
+	}
+}
+
+// commit stores the staged file if every chunk has been received and the
+// file matches its checksum, reporting whether it did not. The session is
+// not locked while the file is hashed and stored, so its status can be read
+// meanwhile; a concurrent commit waits for the running one to end.
+func (s *uploadSession) commit(ctx context.Context, fileStore store.Store) (mismatch bool, err error) {
+	s.mu.Lock()
+	for s.committing != nil {
+		running := s.committing
+		s.mu.Unlock()
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	if s.complete || s.dropped {
+		s.mu.Unlock()
+		return false, nil
+	}
+	for _, ok := range s.received {
+		if !ok {
+			s.mu.Unlock()
+			return false, nil
+		}
+	}
+	done := make(chan struct{})
+	s.committing = done
+	staging := s.staging
+	s.mu.Unlock()
+
+	stored := false
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.committing = nil
+		close(done)
+		if stored {
+			s.complete = true
+			s.discard()
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(staging, 0, s.totalSize)); err != nil {
+		return false, err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != s.checksum {
+		return true, status.Errorf(codes.DataLoss, "upload %q has checksum %s, expected %s", s.id, sum, s.checksum)
+	}
+
+	reader := io.NewSectionReader(staging, 0, s.totalSize)
+	if err := fileStore.Put(ctx, s.fileID, reader, s.totalSize); err != nil {
+		return false, storeError(s.fileID, err)
+	}
+	stored = true
+	return false, nil
+}
+
+// discard closes and removes the staging file. The caller must hold s.mu.
+func (s *uploadSession) discard() {
+	if s.staging == nil {
+		return
+	}
+	if !s.complete {
+		s.dropped = true
+	}
+	s.staging.Close()
+	os.Remove(s.staging.Name())
+	s.staging = nil
+}
+
+// attach marks a stream as writing to the session, so it does not expire
+// while the stream is idle
+func (s *uploadSession) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams++
+}
+
+// detach is called once a stream stops writing to the session
+func (s *uploadSession) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams--
+	s.lastUsed = time.Now()
+}
+
+// writeChunk verifies a chunk and writes it to the staging file
+func (s *uploadSession) writeChunk(chunk *pb.UploadChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.complete {
+		return status.Errorf(codes.FailedPrecondition, "upload %q is already complete", s.id)
+	}
+	if s.dropped {
+		return status.Errorf(codes.NotFound, "upload %q has expired", s.id)
+	}
+	if s.committing != nil {
+		// Every chunk has been received, the client learns the outcome
+		// from the upload's status
+		return status.Errorf(codes.Aborted, "upload %q is being stored", s.id)
+	}
+	if chunk.SequenceNumber < 0 || chunk.SequenceNumber >= s.totalChunks {
+		return status.Errorf(codes.OutOfRange, "chunk %d outside of [0, %d)", chunk.SequenceNumber, s.totalChunks)
+	}
+	offset := int64(chunk.SequenceNumber) * int64(fileChunkSize)
+	expected := s.totalSize - offset
+	if expected > fileChunkSize {
+		expected = fileChunkSize
+	}
+	if int64(len(chunk.ChunkData)) != expected {
+		return status.Errorf(codes.InvalidArgument, "chunk %d has %d bytes, expected %d", chunk.SequenceNumber, len(chunk.ChunkData), expected)
+	}
+	if chunkChecksum(chunk.ChunkData) != chunk.Checksum {
+		// Aborted rather than DataLoss: the chunks received so far are kept
+		// and the client is expected to resend this one
+		return status.Errorf(codes.Aborted, "checksum mismatch on chunk %d", chunk.SequenceNumber)
+	}
+
+	if _, err := s.staging.WriteAt(chunk.ChunkData, offset); err != nil {
+		return err
+	}
+	s.received[chunk.SequenceNumber] = true
+	s.lastUsed = time.Now()
+	return nil
+}
+
+// status reports the progress of the session
+func (s *uploadSession) status() *pb.UploadStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &pb.UploadStatus{
+		UploadId:    s.id,
+		FileId:      s.fileID,
+		TotalSize:   s.totalSize,
+		TotalChunks: s.totalChunks,
+		ChunkSize:   fileChunkSize,
+		Complete:    s.complete,
+	}
+	for i, ok := range s.received {
+		if ok {
+			resp.ReceivedChunks = append(resp.ReceivedChunks, int32(i))
+		}
+	}
+	return resp
+}
+
+// StartUpload opens an upload session for a file
+func (s *server) StartUpload(ctx context.Context, req *pb.StartUploadRequest) (*pb.UploadStatus, error) {
+	session, err := s.uploads.start(ctx, req.FileId, req.TotalSize, req.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	return session.status(), nil
+}
+
+// UploadFile receives chunks of an upload session. Every verified chunk is
+// kept even if the stream fails later, so the client only has to resend the
+// chunks GetUploadStatus does not report.
+func (s *server) UploadFile(stream pb.FileService_UploadFileServer) error {
+	var session *uploadSession
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if session == nil {
+			if session, err = s.uploads.lookup(chunk.UploadId); err != nil {
+				return err
+			}
+			session.attach()
+			defer session.detach()
+		} else if chunk.UploadId != session.id {
+			return status.Errorf(codes.InvalidArgument, "chunk for upload %q sent on the stream of upload %q", chunk.UploadId, session.id)
+		}
+
+		if err := session.writeChunk(chunk); err != nil {
+			return err
+		}
+	}
+
+	if session == nil {
+		return status.Error(codes.InvalidArgument, "no chunks received")
+	}
+	if err := s.uploads.commit(stream.Context(), session); err != nil {
+		return err
+	}
+	return stream.SendAndClose(session.status())
+}
+
+// GetUploadStatus reports which chunks of an upload have been received
+func (s *server) GetUploadStatus(ctx context.Context, req *pb.UploadStatusRequest) (*pb.UploadStatus, error) {
+	session, err := s.uploads.lookup(req.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	return session.status(), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/4erneff/alcatraz/pb/proto"
+	"github.com/4erneff/alcatraz/server/store"
+)
+
+// dialServer serves srv over an in-memory connection and returns a client for it
+func dialServer(t *testing.T, srv *server) pb.FileServiceClient {
+	listener := bufconn.Listen(bufSize)
+	s := grpc.NewServer()
+	pb.RegisterFileServiceServer(s, srv)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewFileServiceClient(conn)
+}
+
+func newUploadServer(t *testing.T) (*server, *store.Memory) {
+	memStore := store.NewMemory()
+	uploads, err := newUploadManager(t.TempDir(), memStore)
+	require.NoError(t, err)
+	return &server{store: memStore, uploads: uploads}, memStore
+}
+
+func uploadChunk(uploadID string, seq int32, data []byte) *pb.UploadChunk {
+	return &pb.UploadChunk{UploadId: uploadID, SequenceNumber: seq, ChunkData: data, Checksum: chunkChecksum(data)}
+}
+
+func TestUploadFile_Resume(t *testing.T) {
+	srv, memStore := newUploadServer(t)
+	client := dialServer(t, srv)
+	ctx := context.Background()
+
+	data := make([]byte, 2*fileChunkSize+5)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	chunks := [][]byte{data[:fileChunkSize], data[fileChunkSize : 2*fileChunkSize], data[2*fileChunkSize:]}
+
+	started, err := client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "up/data.bin", TotalSize: int64(len(data)), Checksum: chunkChecksum(data)})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), started.TotalChunks)
+	assert.Equal(t, int32(fileChunkSize), started.ChunkSize)
+	assert.Empty(t, started.ReceivedChunks)
+
+	// First attempt: chunk 2 arrives, then a corrupted chunk 0 aborts the stream
+	stream, err := client.UploadFile(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(uploadChunk(started.UploadId, 2, chunks[2])))
+	corrupt := uploadChunk(started.UploadId, 0, chunks[0])
+	corrupt.Checksum = chunkChecksum([]byte("something else"))
+	require.NoError(t, stream.Send(corrupt))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.Aborted, status.Code(err), "Corrupted chunk should be rejected with a retryable code")
+
+	progress, err := client.GetUploadStatus(ctx, &pb.UploadStatusRequest{UploadId: started.UploadId})
+	require.NoError(t, err)
+	assert.Equal(t, []int32{2}, progress.ReceivedChunks, "Chunk received before the failure should be kept")
+	assert.False(t, progress.Complete)
+
+	// Restarting the upload rejoins the unfinished session, a different file
+	// of the same size does not
+	rejoined, err := client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "up/data.bin", TotalSize: int64(len(data)), Checksum: chunkChecksum(data)})
+	require.NoError(t, err)
+	assert.Equal(t, started.UploadId, rejoined.UploadId)
+	other, err := client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "up/data.bin", TotalSize: int64(len(data)), Checksum: chunkChecksum(make([]byte, len(data)))})
+	require.NoError(t, err)
+	assert.NotEqual(t, started.UploadId, other.UploadId, "Different content should start a new session")
+	assert.Empty(t, other.ReceivedChunks)
+
+	stream, err = client.UploadFile(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(uploadChunk(started.UploadId, 1, chunks[1])))
+	require.NoError(t, stream.Send(uploadChunk(started.UploadId, 0, chunks[0])))
+	final, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.True(t, final.Complete, "Upload should complete once every chunk arrived")
+	assert.Equal(t, []int32{0, 1, 2}, final.ReceivedChunks)
+
+	info, err := memStore.Stat(ctx, "up/data.bin")
+	require.NoError(t, err, "Completed upload should be stored")
+	assert.Equal(t, int64(len(data)), info.Size)
+	meta, err := client.GetFileMetadata(ctx, &pb.FileMetadataRequest{FileId: "up/data.bin"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), meta.TotalChunks)
+}
+
+func TestUploadFile_Errors(t *testing.T) {
+	srv, _ := newUploadServer(t)
+	client := dialServer(t, srv)
+	ctx := context.Background()
+
+	_, err := client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "../escape", TotalSize: 1, Checksum: chunkChecksum([]byte("a"))})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "small.bin", TotalSize: 3})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Uploads need a whole-file checksum")
+
+	_, err = client.GetUploadStatus(ctx, &pb.UploadStatusRequest{UploadId: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	started, err := client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "small.bin", TotalSize: 3, Checksum: chunkChecksum([]byte("abc"))})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		chunk *pb.UploadChunk
+		code  codes.Code
+	}{
+		{uploadChunk("missing", 0, []byte("abc")), codes.NotFound},
+		{uploadChunk(started.UploadId, 1, []byte("abc")), codes.OutOfRange},
+		{uploadChunk(started.UploadId, 0, []byte("ab")), codes.InvalidArgument},
+	} {
+		stream, err := client.UploadFile(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(tc.chunk))
+		_, err = stream.CloseAndRecv()
+		assert.Equal(t, tc.code, status.Code(err))
+	}
+
+	empty, err := client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "empty.bin", TotalSize: 0, Checksum: chunkChecksum(nil)})
+	require.NoError(t, err)
+	assert.True(t, empty.Complete, "Empty uploads complete immediately")
+}
+
+func TestUploadFile_ChecksumMismatch(t *testing.T) {
+	srv, memStore := newUploadServer(t)
+	client := dialServer(t, srv)
+	ctx := context.Background()
+
+	started, err := client.StartUpload(ctx, &pb.StartUploadRequest{FileId: "small.bin", TotalSize: 3, Checksum: chunkChecksum([]byte("abc"))})
+	require.NoError(t, err)
+	stream, err := client.UploadFile(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(uploadChunk(started.UploadId, 0, []byte("xyz"))))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.DataLoss, status.Code(err), "Content not matching the upload checksum should be rejected")
+
+	_, err = memStore.Stat(ctx, "small.bin")
+	assert.Error(t, err, "Mismatching upload should not be stored")
+	_, err = client.GetUploadStatus(ctx, &pb.UploadStatusRequest{UploadId: started.UploadId})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Mismatching upload should be dropped")
+	entries, err := os.ReadDir(srv.uploads.dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Staging file should be removed")
+}
+
+func TestUploadManager_Expire(t *testing.T) {
+	srv, _ := newUploadServer(t)
+	ctx := context.Background()
+
+	session, err := srv.uploads.start(ctx, "idle.bin", 3, chunkChecksum([]byte("abc")))
+	require.NoError(t, err)
+	staging := filepath.Join(srv.uploads.dir, session.id+".partial")
+	require.FileExists(t, staging)
+
+	// An attached stream keeps the session alive however long it is idle
+	session.attach()
+	srv.uploads.mu.Lock()
+	srv.uploads.expire(time.Now().Add(2 * uploadSessionTTL))
+	srv.uploads.mu.Unlock()
+	_, err = srv.uploads.lookup(session.id)
+	require.NoError(t, err)
+	session.detach()
+
+	srv.uploads.mu.Lock()
+	srv.uploads.expire(time.Now().Add(2 * uploadSessionTTL))
+	srv.uploads.mu.Unlock()
+	_, err = srv.uploads.lookup(session.id)
+	assert.Equal(t, codes.NotFound, status.Code(err), "Idle session should expire")
+	assert.NoFileExists(t, staging, "Staging file of an expired session should be removed")
+	err = session.writeChunk(uploadChunk(session.id, 0, []byte("abc")))
+	assert.Equal(t, codes.NotFound, status.Code(err), "A stream still holding an expired session should fail")
+}
+
+// blockingStore holds every Put until release is closed
+type blockingStore struct {
+	store.Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.Store.Put(ctx, name, r, size)
+}
+
+func TestUploadSession_CommitUnlocked(t *testing.T) {
+	memStore := store.NewMemory()
+	blocking := &blockingStore{Store: memStore, entered: make(chan struct{}, 2), release: make(chan struct{})}
+	uploads, err := newUploadManager(t.TempDir(), blocking)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	data := []byte("abc")
+	session, err := uploads.start(ctx, "slow.bin", int64(len(data)), chunkChecksum(data))
+	require.NoError(t, err)
+	require.NoError(t, session.writeChunk(uploadChunk(session.id, 0, data)))
+
+	first := make(chan error, 1)
+	go func() { first <- uploads.commit(ctx, session) }()
+	<-blocking.entered
+
+	// The session stays usable while the file is stored
+	assert.False(t, session.status().Complete)
+	err = session.writeChunk(uploadChunk(session.id, 0, data))
+	assert.Equal(t, codes.Aborted, status.Code(err), "Chunks sent while the file is stored should be rejected")
+	second := make(chan error, 1)
+	go func() { second <- uploads.commit(ctx, session) }()
+
+	close(blocking.release)
+	require.NoError(t, <-first)
+	require.NoError(t, <-second, "A concurrent commit should wait for the running one")
+	assert.True(t, session.status().Complete)
+	assert.Len(t, blocking.entered, 0, "The file should be stored once")
+	stored, err := memStore.Stat(ctx, "slow.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), stored.Size)
+}
@@ -0,0 +1,222 @@
+// Package synthetic produces deterministic test files whose content is
+// computed on the fly from a pattern and a seed.
+//
+// Any byte range of a file can be produced without the bytes before it, so a
+// server can serve files far larger than its disk and a client can
+// regenerate the bytes it expects to receive and check them end to end.
+// Synthetic files are addressed by names such as "synthetic/10GiB?seed=42".
+package synthetic
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Pattern selects the content of a generated file
+type Pattern string
+
+const (
+	PatternZeros  Pattern = "zeros"  // Every byte is zero
+	PatternRandom Pattern = "random" // Seeded pseudo-random bytes, incompressible
+	PatternRepeat Pattern = "repeat" // A seeded pseudo-random 4KB block, repeated
+	PatternText   Pattern = "text"   // Seeded lines of words, compressible like a log file
+)
+
+const (
+	repeatBlockSize = 4096 // Length of the block PatternRepeat repeats
+	textLineSize    = 64   // Length of a PatternText line including its newline
+)
+
+// textWords are the words PatternText lines are made of
+var textWords = []string{"alpha", "bravo", "chunk", "delta", "echo", "file", "grpc", "hash", "index", "journal", "kilo", "lima", "merkle", "node", "offset", "proto"}
+
+// Generator produces the content of a synthetic file. The content only
+// depends on the pattern and seed, so any range can be produced without the
+// bytes before it and the same settings always produce the same file.
+type Generator struct {
+	pattern Pattern
+	size    int64
+	seed    uint64
+	block   []byte // Repeated block of PatternRepeat
+}
+
+// NewGenerator returns a generator of a size byte file with the given pattern
+func NewGenerator(pattern Pattern, size int64, seed int64) (*Generator, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("generated file size must not be negative, got %d", size)
+	}
+	g := &Generator{pattern: pattern, size: size, seed: uint64(seed)}
+	switch pattern {
+	case PatternZeros, PatternRandom, PatternText:
+	case PatternRepeat:
+		g.block = make([]byte, repeatBlockSize)
+		g.random(g.block, 0)
+	default:
+		return nil, fmt.Errorf("unknown pattern %q", pattern)
+	}
+	return g, nil
+}
+
+// Size returns the size of the generated file in bytes
+func (g *Generator) Size() int64 {
+	return g.size
+}
+
+// ReadAt fills p with the content at offset off
+func (g *Generator) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%w: negative offset %d", fs.ErrInvalid, off)
+	}
+	if off >= g.size {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > g.size-off {
+		p, err = p[:g.size-off], io.EOF
+	}
+
+	switch g.pattern {
+	case PatternZeros:
+		clear(p)
+	case PatternRandom:
+		g.random(p, off)
+	case PatternRepeat:
+		for i := range p {
+			p[i] = g.block[(off+int64(i))%repeatBlockSize]
+		}
+	case PatternText:
+		var line []byte
+		lineIndex := int64(-1)
+		for i := range p {
+			pos := off + int64(i)
+			if pos/textLineSize != lineIndex {
+				lineIndex = pos / textLineSize
+				line = g.textLine(lineIndex)
+			}
+			p[i] = line[pos%textLineSize]
+		}
+	}
+	return len(p), err
+}
+
+// random fills p with the pseudo-random bytes at offset off. Every 8-byte
+// word is derived from the seed and its index alone.
+func (g *Generator) random(p []byte, off int64) {
+	var word uint64
+	for i := range p {
+		pos := off + int64(i)
+		if i == 0 || pos%8 == 0 {
+			word = splitmix64(g.seed + uint64(pos/8))
+		}
+		p[i] = byte(word >> (8 * (pos % 8)))
+	}
+}
+
+// textLine returns line n of a PatternText file
+func (g *Generator) textLine(n int64) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%010d", n)
+	state := splitmix64(g.seed ^ uint64(n)*0xbf58476d1ce4e5b9)
+	for b.Len() < textLineSize-1 {
+		b.WriteByte(' ')
+		b.WriteString(textWords[state%uint64(len(textWords))])
+		state = splitmix64(state)
+	}
+	line := []byte(b.String())[:textLineSize-1]
+	return append(line, '\n')
+}
+
+// splitmix64 scrambles x into a well distributed pseudo-random value
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Prefix starts the name of every synthetic file
+const Prefix = "synthetic/"
+
+// ErrInvalidName is returned by Parse for malformed synthetic file names
+var ErrInvalidName = errors.New("invalid synthetic file name")
+
+// sizeUnits are the suffixes a synthetic file size may carry
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// IsName reports whether name addresses a synthetic file
+func IsName(name string) bool {
+	return strings.HasPrefix(name, Prefix)
+}
+
+// Parse returns the generator of the synthetic file name, of the form
+// synthetic/<size>[?seed=<n>&pattern=<pattern>]. The size is a number of
+// bytes with an optional unit such as KiB, MB or GiB. The seed defaults to 0
+// and the pattern to random.
+func Parse(name string) (*Generator, error) {
+	if !IsName(name) {
+		return nil, fmt.Errorf("%w: %q does not start with %q", ErrInvalidName, name, Prefix)
+	}
+	sizeText, rawQuery, _ := strings.Cut(strings.TrimPrefix(name, Prefix), "?")
+	size, err := parseSize(sizeText)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidName, name, err)
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidName, name, err)
+	}
+	pattern, seed := PatternRandom, int64(0)
+	for key, values := range query {
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%w: %q: %s given %d times", ErrInvalidName, name, key, len(values))
+		}
+		switch key {
+		case "seed":
+			if seed, err = strconv.ParseInt(values[0], 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: %q: seed: %v", ErrInvalidName, name, err)
+			}
+		case "pattern":
+			pattern = Pattern(values[0])
+		default:
+			return nil, fmt.Errorf("%w: %q: unknown parameter %s", ErrInvalidName, name, key)
+		}
+	}
+
+	gen, err := NewGenerator(pattern, size, seed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidName, name, err)
+	}
+	return gen, nil
+}
+
+// parseSize parses a number of bytes with an optional unit
+func parseSize(s string) (int64, error) {
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if number, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s, factor = number, unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("malformed size %q", s)
+	}
+	if n > (1<<63-1)/factor {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * factor, nil
+}
@@ -0,0 +1,82 @@
+package synthetic
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerator(t *testing.T) {
+	read := func(pattern Pattern, seed int64, off int64, n int) []byte {
+		gen, err := NewGenerator(pattern, 1<<20, seed)
+		require.NoError(t, err)
+		data := make([]byte, n)
+		_, err = gen.ReadAt(data, off)
+		require.NoError(t, err)
+		return data
+	}
+
+	for _, pattern := range []Pattern{PatternZeros, PatternRandom, PatternRepeat, PatternText} {
+		whole := read(pattern, 7, 0, 20000)
+		assert.Equal(t, whole, read(pattern, 7, 0, 20000), "%s should be reproducible", pattern)
+		assert.Equal(t, whole[4099:15003], read(pattern, 7, 4099, 10904), "%s ranges should match the whole file", pattern)
+	}
+
+	assert.Equal(t, make([]byte, 64), read(PatternZeros, 7, 100, 64))
+	assert.NotEqual(t, read(PatternRandom, 1, 0, 64), read(PatternRandom, 2, 0, 64), "Seeds should change the content")
+	repeat := read(PatternRepeat, 3, 0, 3*repeatBlockSize)
+	assert.Equal(t, repeat[:repeatBlockSize], repeat[2*repeatBlockSize:])
+	text := read(PatternText, 5, 0, 4*textLineSize)
+	assert.Equal(t, 4, strings.Count(string(text), "\n"), "Text should consist of fixed length lines")
+
+	gen, err := NewGenerator(PatternRandom, 10, 0)
+	require.NoError(t, err)
+	n, err := gen.ReadAt(make([]byte, 8), 6)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, io.EOF, err, "Reads past the end should be short")
+
+	_, err = NewGenerator("noise", 10, 0)
+	assert.Error(t, err, "Unknown patterns should be rejected")
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		size    int64
+		pattern Pattern
+	}{
+		"synthetic/0":                        {0, PatternRandom},
+		"synthetic/123":                      {123, PatternRandom},
+		"synthetic/10GiB?seed=42":            {10 << 30, PatternRandom},
+		"synthetic/2MB?pattern=text&seed=-1": {2e6, PatternText},
+		"synthetic/4KiB?pattern=zeros":       {4096, PatternZeros},
+	}
+	for name, want := range tests {
+		gen, err := Parse(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want.size, gen.Size(), name)
+		assert.Equal(t, want.pattern, gen.pattern, name)
+	}
+
+	a, _ := Parse("synthetic/1KiB?seed=1")
+	b, _ := Parse("synthetic/1KiB?seed=2")
+	assert.Equal(t, uint64(1), a.seed)
+	assert.NotEqual(t, a.seed, b.seed)
+
+	for _, name := range []string{
+		"large_file.bin",
+		"synthetic/",
+		"synthetic/10XB",
+		"synthetic/-1",
+		"synthetic/1KiB?seed=x",
+		"synthetic/1KiB?seed=1&seed=2",
+		"synthetic/1KiB?pattern=noise",
+		"synthetic/1KiB?colour=red",
+		"synthetic/99999999TiB",
+	} {
+		_, err := Parse(name)
+		assert.ErrorIs(t, err, ErrInvalidName, name)
+	}
+}